@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// ChannelRole is the access level an identity has on a channel.
+type ChannelRole uint8
+
+const (
+	RoleNone ChannelRole = iota
+	RoleRead
+	RoleWrite
+	RoleOwner
+)
+
+var roleNames = map[ChannelRole]string{
+	RoleNone:  "none",
+	RoleRead:  "read",
+	RoleWrite: "write",
+	RoleOwner: "owner",
+}
+
+func (r ChannelRole) String() string { return roleNames[r] }
+
+func (r ChannelRole) MarshalText() ([]byte, error) { return []byte(r.String()), nil }
+
+func (r *ChannelRole) UnmarshalText(b []byte) error {
+	for role, name := range roleNames {
+		if name == string(b) {
+			*r = role
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown role %q", b)
+}
+
+// channelACL makes a channel private to its owner and members.
+type channelACL struct {
+	Owner   string
+	Members map[string]ChannelRole
+}
+
+// maxOwnedChannels and maxMembers bound the ACLs one identity can
+// create. All ACLs together are also bounded by max_channels.
+const (
+	maxOwnedChannels = 100
+	maxMembers       = 100
+)
+
+var (
+	aclMu sync.Mutex                 // guards following
+	acls  = map[string]*channelACL{} // channel ID -> ACL; absent means public
+)
+
+// channelRole returns the role of the named identity on channel id.
+// Everyone may read and write channels that have not been claimed.
+func channelRole(id, name string) ChannelRole {
+	aclMu.Lock()
+	defer aclMu.Unlock()
+
+	acl := acls[id]
+	switch {
+	case acl == nil:
+		return RoleWrite
+	case acl.Owner == name:
+		return RoleOwner
+	default:
+		return acl.Members[name]
+	}
+}
+
+func isPrivate(id string) bool {
+	aclMu.Lock()
+	defer aclMu.Unlock()
+	return acls[id] != nil
+}
+
+// authorize reports whether the request's identity has at least role
+// need on channel id, replying 403 if it does not. Channels are public
+// when authentication is disabled.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, id string, need ChannelRole) bool {
+	if s.auth == nil {
+		return true
+	}
+	ident, _ := identityFrom(r.Context())
+	if channelRole(id, ident.Name) < need {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// serveACL shows (GET) or changes (POST) the access control list of a
+// channel. A POST without parameters claims an unowned channel for the
+// caller, making it private. Only API-key identities can claim, and
+// only channels without messages from anyone else. The owner may then set member=<name> and
+// role=read|write|none, or release=1 to make the channel public again.
+func (s *Server) serveACL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.auth == nil {
+		http.Error(w, "authentication disabled", http.StatusNotFound)
+		return
+	}
+
+	id, reason := parseID(r)
+	if reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return
+	}
+
+	ident, _ := identityFrom(r.Context())
+
+	if r.Method == http.MethodGet {
+		if !s.authorize(w, r, id, RoleRead) {
+			return
+		}
+	} else {
+		if reason, code := updateACL(id, ident, r); reason != "" {
+			http.Error(w, reason, code)
+			return
+		}
+		shareChannelState(id)
+	}
+
+	aclMu.Lock()
+	resp := struct {
+		ID      string
+		Owner   string                 `json:",omitempty"`
+		Members map[string]ChannelRole `json:",omitempty"`
+	}{ID: id}
+	if acl := acls[id]; acl != nil {
+		resp.Owner = acl.Owner
+		resp.Members = make(map[string]ChannelRole, len(acl.Members))
+		for name, role := range acl.Members {
+			resp.Members[name] = role
+		}
+	}
+	aclMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ownHistory reports whether every user message in channel id was
+// sent by name, which holds for channels without messages.
+func ownHistory(id, name string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, mj := range recent[id] {
+		if mj.Role == UserMessage && mj.Author != name {
+			return false
+		}
+	}
+	return true
+}
+
+func updateACL(id string, ident Identity, r *http.Request) (reason string, code int) {
+	caller := ident.Name
+	member, role, release := r.FormValue("member"), r.FormValue("role"), r.FormValue("release")
+
+	aclMu.Lock()
+	defer aclMu.Unlock()
+
+	acl := acls[id]
+
+	if member == "" && role == "" && release == "" {
+		switch {
+		case acl == nil:
+			// Holders of channel tokens only act for whoever minted
+			// them, and claiming a channel others use would lock them
+			// out of it.
+			if ident.Channel != "" {
+				return "channel tokens cannot claim channels", http.StatusForbidden
+			}
+			if !ownHistory(id, caller) {
+				return "channel has messages from others", http.StatusForbidden
+			}
+			if max := config().Retention.MaxChannels; max > 0 && len(acls) >= max {
+				return "too many private channels", http.StatusServiceUnavailable
+			}
+			owned := 0
+			for _, acl := range acls {
+				if acl.Owner == caller {
+					owned++
+				}
+			}
+			if owned >= maxOwnedChannels {
+				return fmt.Sprintf("cannot own more than %d channels", maxOwnedChannels), http.StatusForbidden
+			}
+			acls[id] = &channelACL{Owner: caller, Members: map[string]ChannelRole{}}
+			return "", 0
+		case acl.Owner == caller:
+			return "", 0
+		default:
+			return "channel already owned", http.StatusConflict
+		}
+	}
+
+	if acl == nil || acl.Owner != caller {
+		return "only the channel owner can change its ACL", http.StatusForbidden
+	}
+
+	if release == "1" {
+		delete(acls, id)
+		return "", 0
+	}
+
+	if reason := validNick(member); reason != "" {
+		return "member: " + reason, http.StatusBadRequest
+	}
+	if member == acl.Owner {
+		return "cannot change the owner's role", http.StatusBadRequest
+	}
+
+	if _, ok := acl.Members[member]; !ok && role != "none" && len(acl.Members) >= maxMembers {
+		return fmt.Sprintf("a channel can have at most %d members", maxMembers), http.StatusForbidden
+	}
+
+	switch role {
+	case "read":
+		acl.Members[member] = RoleRead
+	case "write":
+		acl.Members[member] = RoleWrite
+	case "none":
+		delete(acl.Members, member)
+	default:
+		return "role must be one of read, write, none", http.StatusBadRequest
+	}
+	return "", 0
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// requireAdmin wraps h so that it only runs for the API keys listed in
+// the admins setting. Channel tokens are never admins, and the admin
+// API is off when authentication is disabled.
+func (s *Server) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil {
+			http.Error(w, "authentication disabled", http.StatusNotFound)
+			return
+		}
+		ident, _ := identityFrom(r.Context())
+		if ident.Channel != "" || !slices.Contains(config().Admins, ident.Name) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// ChannelInfo summarizes a channel for the admin API.
+type ChannelInfo struct {
+	ID           string
+	Messages     int
+	Bytes        int       // size of the messages as JSON
+	LastActivity time.Time `json:",omitzero"` // of the last message
+	Waiters      int
+	Generations  int
+	Private      bool
+}
+
+// serveAdminChannels lists the channels holding messages or waiters,
+// most recently active first.
+func (s *Server) serveAdminChannels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	infos := map[string]*ChannelInfo{}
+	info := func(id string) *ChannelInfo {
+		if infos[id] == nil {
+			infos[id] = &ChannelInfo{ID: id}
+		}
+		return infos[id]
+	}
+	mu.Lock()
+	for id, list := range recent {
+		ci := info(id)
+		ci.Messages = len(list)
+		for _, mj := range list {
+			ci.Bytes += len(mj.json)
+		}
+		if len(list) > 0 {
+			ci.LastActivity = list[len(list)-1].Time.Time()
+		}
+	}
+	for id, chans := range waiting {
+		info(id).Waiters = len(chans)
+	}
+	mu.Unlock()
+	for _, g := range s.wkr.Generations() {
+		info(g.Channel).Generations++
+	}
+
+	list := make([]*ChannelInfo, 0, len(infos))
+	for _, ci := range infos {
+		ci.Private = isPrivate(ci.ID)
+		list = append(list, ci)
+	}
+	slices.SortFunc(list, func(a, b *ChannelInfo) int {
+		if c := b.LastActivity.Compare(a.LastActivity); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(list)
+}
+
+// serveAdminPurge deletes the messages of a channel, or all but the
+// last keep of them, on every instance sharing the bus. The reply
+// counts the messages removed here.
+func (s *Server) serveAdminPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, reason := parseID(r)
+	if reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return
+	}
+	keep := 0
+	if v := r.FormValue("keep"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "keep must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		keep = n
+	}
+
+	n := truncate(id, keep)
+	bus.PublishTruncate(id, keep)
+	ident, _ := identityFrom(r.Context())
+	slog.InfoContext(r.Context(), "purged channel", "admin", ident.Name, "channel", id, "keep", keep, "removed", n)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		ID      string
+		Removed int
+	}{id, n})
+}
+
+// WaiterInfo counts the long polls waiting on a channel.
+type WaiterInfo struct {
+	Channel string
+	Count   int
+	Oldest  time.Time // when the longest-waiting poll started
+}
+
+// serveAdminWork lists the long polls and the generations in progress.
+func (s *Server) serveAdminWork(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := struct {
+		Draining    bool
+		Waiters     []WaiterInfo
+		Generations []generation
+	}{
+		Draining:    s.wkr.Draining(),
+		Waiters:     []WaiterInfo{},
+		Generations: s.wkr.Generations(),
+	}
+	mu.Lock()
+	for id, chans := range waiting {
+		wi := WaiterInfo{Channel: id, Count: len(chans)}
+		for _, since := range chans {
+			if wi.Oldest.IsZero() || since.Before(wi.Oldest) {
+				wi.Oldest = since
+			}
+		}
+		resp.Waiters = append(resp.Waiters, wi)
+	}
+	mu.Unlock()
+	slices.SortFunc(resp.Waiters, func(a, b WaiterInfo) int { return cmp.Compare(a.Channel, b.Channel) })
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveAdminCancel cancels the generation with the given ID, or all
+// generations in a channel.
+func (s *Server) serveAdminCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var match func(*generation) bool
+	if v := r.FormValue("generation"); v != "" {
+		gen, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "generation must be an ID", http.StatusBadRequest)
+			return
+		}
+		match = func(g *generation) bool { return g.ID == gen }
+	} else {
+		id, reason := parseID(r)
+		if reason != "" {
+			http.Error(w, "generation or id is required", http.StatusBadRequest)
+			return
+		}
+		match = func(g *generation) bool { return g.Channel == id }
+	}
+
+	n := s.wkr.Cancel(match)
+	ident, _ := identityFrom(r.Context())
+	slog.InfoContext(r.Context(), "cancelled generations", "admin", ident.Name,
+		"generation", r.FormValue("generation"), "channel", r.FormValue("id"), "cancelled", n)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct{ Cancelled int }{n})
+}
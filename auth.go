@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identity is the authenticated principal behind a request.
+type Identity struct {
+	// Name is the API key name or the channel token subject.
+	Name string
+	// Channel restricts a token identity to a single channel. It is
+	// empty for API keys, which may access any channel.
+	Channel string
+	Expires time.Time // of a token
+}
+
+// Auth validates static API keys and HMAC-signed channel tokens.
+type Auth struct {
+	keys   map[[sha256.Size]byte]string // sha256(key) -> name
+	secret []byte                       // HMAC key for channel tokens
+}
+
+const (
+	tokenCookie = "burp_token"
+
+	defaultTokenTTL = 24 * time.Hour
+	maxTokenTTL     = 30 * 24 * time.Hour
+	chatTokenTTL    = 8 * time.Hour // for the chat page
+)
+
+// LoadAuth reads API keys from path, one "<name> <key>" pair per line.
+// Blank lines and lines starting with '#' are ignored. If secret is
+// empty, a random one is generated and tokens do not survive restarts.
+func LoadAuth(path string, secret []byte) (*Auth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &Auth{keys: map[[sha256.Size]byte]string{}, secret: secret}
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, key, ok := strings.Cut(line, " ")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"<name> <key>\"", path, n)
+		}
+		// Key names are nicknames, so they follow the same rules.
+		if reason := validNick(name); reason != "" {
+			return nil, fmt.Errorf("%s:%d: key name %q: %s", path, n, name, reason)
+		}
+		a.keys[sha256.Sum256([]byte(key))] = name
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(a.keys) == 0 {
+		return nil, fmt.Errorf("%s: no API keys", path)
+	}
+
+	if len(a.secret) == 0 {
+		a.secret = make([]byte, 32)
+		if _, err := rand.Read(a.secret); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Sign returns a token granting sub access to channel id until exp.
+func (a *Auth) Sign(id, sub string, exp time.Time) string {
+	payload := id + "." + sub + "." + strconv.FormatInt(exp.Unix(), 10)
+	return payload + "." + a.mac(payload)
+}
+
+func (a *Auth) mac(payload string) string {
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (a *Auth) isKeyName(name string) bool {
+	for _, n := range a.keys {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyToken checks the signature and expiry of a channel token.
+func (a *Auth) verifyToken(tok string) (Identity, bool) {
+	i := strings.LastIndexByte(tok, '.')
+	if i < 0 {
+		return Identity{}, false
+	}
+	payload, sig := tok[:i], tok[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(a.mac(payload))) {
+		return Identity{}, false
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return Identity{}, false
+	}
+	exp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return Identity{}, false
+	}
+	return Identity{Name: parts[1], Channel: parts[0], Expires: time.Unix(exp, 0)}, true
+}
+
+// credential extracts the bearer credential from the Authorization
+// header, the token URL parameter or the token cookie, in that order.
+// URLs end up in logs and browser history, so a credential from the
+// token parameter may only be a channel token, which inURL reports.
+func credential(r *http.Request) (cred string, inURL bool) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if v, ok := strings.CutPrefix(h, "Bearer "); ok {
+			return strings.TrimSpace(v), false
+		}
+	}
+	if v := r.URL.Query().Get("token"); v != "" {
+		return v, true
+	}
+	if c, err := r.Cookie(tokenCookie); err == nil {
+		return c.Value, false
+	}
+	return "", false
+}
+
+func (a *Auth) authenticate(r *http.Request) (Identity, bool) {
+	cred, inURL := credential(r)
+	if inURL {
+		return a.verifyToken(cred)
+	}
+	return a.check(cred)
+}
+
+// check validates an API key or channel token.
+func (a *Auth) check(cred string) (Identity, bool) {
+	if cred == "" {
+		return Identity{}, false
+	}
+	if name, ok := a.keys[sha256.Sum256([]byte(cred))]; ok {
+		return Identity{Name: name}, true
+	}
+	return a.verifyToken(cred)
+}
+
+// require wraps h so that it only runs for authenticated requests.
+// Channel tokens are only accepted for requests whose id parameter
+// matches the channel they were issued for, except on handlers that
+// are not bound to a channel. A nil Auth disables authentication.
+func (a *Auth) require(h http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ident, ok := a.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="burp"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if ident.Channel != "" {
+			if id := r.FormValue("id"); id != "" && id != ident.Channel {
+				http.Error(w, "token not valid for this channel", http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r.WithContext(withIdentity(r.Context(), ident)))
+	}
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, ident Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, ident)
+}
+
+// identityFrom returns the identity stored in ctx, if any.
+func identityFrom(ctx context.Context) (Identity, bool) {
+	ident, ok := ctx.Value(identityKey{}).(Identity)
+	return ident, ok
+}
+
+// serveToken mints a channel token. Only API keys may mint tokens, and
+// only for themselves unless they own the channel.
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.auth == nil {
+		http.Error(w, "authentication disabled", http.StatusNotFound)
+		return
+	}
+
+	ident, _ := identityFrom(r.Context())
+	if ident.Channel != "" {
+		http.Error(w, "channel tokens cannot mint tokens", http.StatusForbidden)
+		return
+	}
+
+	id, reason := parseID(r)
+	if reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return
+	}
+
+	sub := ident.Name
+	if v := r.FormValue("sub"); v != "" && v != sub {
+		if reason := validNick(v); reason != "" {
+			http.Error(w, "sub: "+reason, http.StatusBadRequest)
+			return
+		}
+		if s.auth.isKeyName(v) {
+			http.Error(w, "sub cannot name another API key", http.StatusForbidden)
+			return
+		}
+		// Tokens for other subjects would let anyone post under any
+		// nickname, so only owners may grant them, on channels whose
+		// ACL can revoke them.
+		if channelRole(id, ident.Name) != RoleOwner {
+			http.Error(w, "only the channel owner can mint tokens for others", http.StatusForbidden)
+			return
+		}
+		sub = v
+	}
+
+	ttl := defaultTokenTTL
+	if v := r.FormValue("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "ttl must be a duration", http.StatusBadRequest)
+			return
+		}
+		if d <= 0 || d > maxTokenTTL {
+			http.Error(w, "ttl out of range (0–720h)", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	exp := time.Now().Add(ttl)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		Token   string
+		Expires time.Time
+	}{
+		Token:   s.auth.Sign(id, sub, exp),
+		Expires: exp.UTC(),
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAuth() *Auth {
+	return &Auth{
+		keys:   map[[sha256.Size]byte]string{sha256.Sum256([]byte("k1")): "alice"},
+		secret: []byte("secret"),
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	a := testAuth()
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	tok := a.Sign("emu", "bob", exp)
+
+	ident, ok := a.verifyToken(tok)
+	if !ok {
+		t.Fatalf("valid token %q refused", tok)
+	}
+	if ident.Name != "bob" || ident.Channel != "emu" || !ident.Expires.Equal(exp) {
+		t.Fatalf("verifyToken = %+v", ident)
+	}
+
+	other := &Auth{secret: []byte("other")}
+	payload := tok[:strings.LastIndexByte(tok, '.')]
+
+	tests := []struct {
+		name, tok string
+	}{
+		{"expired", a.Sign("emu", "bob", time.Now().Add(-time.Second))},
+		{"expiring now", a.Sign("emu", "bob", time.Now())},
+		{"other secret", other.Sign("emu", "bob", exp)},
+		{"other channel", strings.Replace(tok, "emu.", "owl.", 1)},
+		{"other subject", strings.Replace(tok, ".bob.", ".eve.", 1)},
+		{"later expiry", strings.Replace(tok, ".bob.", ".bob.9", 1)},
+		{"truncated signature", tok[:len(tok)-1]},
+		{"no signature", payload},
+		{"extra field", a.Sign("emu", "bob.x", exp)},
+		{"bad expiry", "emu.bob.soon." + a.mac("emu.bob.soon")},
+		{"API key", "k1"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		if ident, ok := a.verifyToken(tt.tok); ok {
+			t.Errorf("%s: verifyToken(%q) = %+v, want refusal", tt.name, tt.tok, ident)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	a := testAuth()
+	tok := a.Sign("emu", "bob", time.Now().Add(time.Hour))
+	h := a.require(func(w http.ResponseWriter, r *http.Request) {
+		ident, _ := identityFrom(r.Context())
+		w.Write([]byte(ident.Name))
+	})
+
+	tests := []struct {
+		name, url, header string
+		code              int
+		who               string
+	}{
+		{"key", "/recent?id=owl", "Bearer k1", http.StatusOK, "alice"},
+		{"token", "/recent?id=emu", "Bearer " + tok, http.StatusOK, "bob"},
+		{"token in URL", "/recent?id=emu&token=" + tok, "", http.StatusOK, "bob"},
+		{"token without channel", "/models", "Bearer " + tok, http.StatusOK, "bob"},
+		{"token for other channel", "/recent?id=owl", "Bearer " + tok, http.StatusForbidden, ""},
+		{"token in URL for other channel", "/recent?id=owl&token=" + tok, "", http.StatusForbidden, ""},
+		{"key in URL", "/recent?id=owl&token=k1", "", http.StatusUnauthorized, ""},
+		{"wrong key", "/recent?id=owl", "Bearer k2", http.StatusUnauthorized, ""},
+		{"no credential", "/recent?id=owl", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.code)
+			continue
+		}
+		if tt.code == http.StatusOK && w.Body.String() != tt.who {
+			t.Errorf("%s: identity %q, want %q", tt.name, w.Body.String(), tt.who)
+		}
+	}
+}
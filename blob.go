@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Attachment is a file attached to a user message. Its contents are
+// kept in the blob store under Hash.
+type Attachment struct {
+	Name string
+	// Type is the sniffed MIME type.
+	Type string
+	Size int64
+	// Hash is the hex SHA-256 of the contents.
+	Hash string
+}
+
+const (
+	maxAttachments   = 8
+	maxImageBytes    = 5 << 20  // Anthropic's per-image limit
+	maxDocumentBytes = 32 << 20 // both providers' PDF limit
+	maxUploadBytes   = 32 << 20 // whole multipart request
+)
+
+// attachmentCaps maps the accepted attachment types to the model
+// capability they require.
+var attachmentCaps = map[string]ModelCap{
+	"image/png":       CapVision,
+	"image/jpeg":      CapVision,
+	"image/gif":       CapVision,
+	"image/webp":      CapVision,
+	"application/pdf": CapPDF,
+}
+
+var attachmentKinds = map[ModelCap]string{
+	CapVision: "images",
+	CapPDF:    "PDF documents",
+}
+
+// BlobStore keeps attachment contents in a directory, addressed by the
+// SHA-256 of their contents so that repeated uploads are stored once.
+type BlobStore struct {
+	dir string
+}
+
+func NewBlobStore(dir string) (*BlobStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &BlobStore{dir: dir}, nil
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func (b *BlobStore) path(hash string) string {
+	return filepath.Join(b.dir, hash)
+}
+
+// Put stores the contents of r and returns their hash and size.
+func (b *BlobStore) Put(r io.Reader) (hash string, size int64, err error) {
+	f, err := os.CreateTemp(b.dir, ".upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(f.Name()) // no-op after the rename
+
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash = hex.EncodeToString(h.Sum(nil))
+	if err := os.Rename(f.Name(), b.path(hash)); err != nil {
+		return "", 0, err
+	}
+	return hash, size, nil
+}
+
+// Get returns the contents stored under hash.
+func (b *BlobStore) Get(hash string) ([]byte, error) {
+	if !validHash(hash) {
+		return nil, errors.New("invalid blob hash")
+	}
+	return os.ReadFile(b.path(hash))
+}
+
+// blobGrace is how long a blob no message refers to is kept, so that
+// uploads aren't removed before their message is published.
+const blobGrace = 10 * time.Minute
+
+// Sweep removes the blobs, and uploads left behind, that no recent
+// message refers to, and returns how many it removed.
+func (b *BlobStore) Sweep() (int, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	keep := map[string]bool{}
+	mu.Lock()
+	for _, list := range recent {
+		for _, msg := range list {
+			for _, a := range msg.Attachments {
+				keep[a.Hash] = true
+			}
+		}
+	}
+	mu.Unlock()
+
+	n := 0
+	for _, e := range entries {
+		if e.IsDir() || keep[e.Name()] {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil || time.Since(fi.ModTime()) < blobGrace {
+			continue
+		}
+		if err := os.Remove(b.path(e.Name())); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// sweepEvery runs Sweep every interval until ctx is done.
+func (b *BlobStore) sweepEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		n, err := b.Sweep()
+		if err != nil {
+			slog.Error("cannot sweep blobs", "err", err)
+		} else if n > 0 {
+			slog.Info("removed unreferenced blobs", "count", n)
+		}
+	}
+}
+
+// readAttachments validates and stores the attachments of a multipart
+// /ask request, sent in "file" parts.
+func (s *Server) readAttachments(r *http.Request, model ChatModel) (atts []*Attachment, reason string) {
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		return nil, ""
+	}
+	if s.wkr.blobs == nil {
+		return nil, "attachments disabled"
+	}
+	if len(files) > maxAttachments {
+		return nil, fmt.Sprintf("at most %d attachments", maxAttachments)
+	}
+
+	for _, fh := range files {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, "unreadable attachment"
+		}
+
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		typ, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+
+		need, ok := attachmentCaps[typ]
+		limit := int64(maxImageBytes)
+		if need == CapPDF {
+			limit = maxDocumentBytes
+		}
+		switch {
+		case !ok:
+			reason = "unsupported attachment type " + typ
+		case modelCaps[model]&need == 0:
+			reason = "model does not support " + attachmentKinds[need]
+		case fh.Size > limit:
+			reason = fmt.Sprintf("%s exceeds %d MB", typ, limit>>20)
+		}
+		if reason != "" {
+			f.Close()
+			return nil, reason
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, "unreadable attachment"
+		}
+		hash, size, err := s.wkr.blobs.Put(f)
+		f.Close()
+		if err != nil {
+			return nil, "cannot store attachment"
+		}
+
+		atts = append(atts, &Attachment{
+			Name: attachmentName(fh.Filename),
+			Type: typ,
+			Size: size,
+			Hash: hash,
+		})
+	}
+	return atts, ""
+}
+
+// attachmentName strips directories from an uploaded file name and
+// bounds its length.
+func attachmentName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" {
+		return "attachment"
+	}
+	for len(name) > 128 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// findAttachment returns the attachment with hash posted to channel id.
+func findAttachment(id, hash string) *Attachment {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, msg := range recent[id] {
+		for _, a := range msg.Attachments {
+			if a.Hash == hash {
+				return a
+			}
+		}
+	}
+	return nil
+}
+
+// serveBlob serves an attachment of a recent message in a channel.
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, reason := parseID(r)
+	if reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return
+	}
+	if !s.authorize(w, r, id, RoleRead) {
+		return
+	}
+
+	hash := r.FormValue("hash")
+	a := findAttachment(id, hash)
+	if a == nil || s.wkr.blobs == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(s.wkr.blobs.path(a.Hash))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", a.Type)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": a.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	http.ServeContent(w, r, a.Name, time.Time{}, f)
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Bus carries published messages to the other burp instances serving
+// the same channels, so that their long polls see them. publish
+// delivers messages to this instance itself; a Bus receives the
+// messages of other instances and hands them to receive. Changes to
+// the access lists and modes of channels, and purges, are shared too.
+type Bus interface {
+	// Publish sends msg to the other instances. It doesn't block.
+	Publish(msg *Message)
+	// PublishStates sends the access lists and modes of channels to
+	// the other instances. It doesn't block.
+	PublishStates(sts []*channelState)
+	// PublishTruncate has the other instances drop all but the last
+	// keep messages of channel id. It doesn't block.
+	PublishTruncate(id string, keep int)
+	// Close flushes pending messages and stops receiving. Messages
+	// published after Close are dropped.
+	Close() error
+}
+
+// bus is the Bus in use; a single instance needs none.
+var bus Bus = localBus{}
+
+type localBus struct{}
+
+func (localBus) Publish(*Message)              {}
+func (localBus) PublishStates([]*channelState) {}
+func (localBus) PublishTruncate(string, int)   {}
+func (localBus) Close() error                  { return nil }
+
+// OpenBus connects to the bus at rawURL, of the form
+// redis://[:password@]host[:port], and shares messages on the Redis
+// channel named channel.
+func OpenBus(rawURL, channel string) (Bus, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported bus %q", rawURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	password, _ := u.User.Password()
+
+	b := &redisBus{
+		addr:     addr,
+		password: password,
+		channel:  channel,
+		instance: newInstanceID(),
+		queue:    make(chan []byte, 1024),
+	}
+	// Fail early if the server can't be reached; later failures are
+	// retried.
+	c, err := b.dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.stop = cancel
+	b.wg.Add(2)
+	go b.publishLoop(c)
+	go b.subscribeLoop(ctx)
+	return b, nil
+}
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// busEnvelope is the payload sent on the bus. It carries one of
+// Message, States, Truncate or Sync.
+type busEnvelope struct {
+	Instance string          // sender, which ignores its own messages
+	Message  *Message        `json:",omitempty"`
+	States   []*channelState `json:",omitempty"`
+	Truncate *busTruncate    `json:",omitempty"`
+	// Sync asks the other instances for the state of all channels;
+	// an instance sends it when it subscribes.
+	Sync bool `json:",omitempty"`
+}
+
+// busTruncate asks to drop all but the last Keep messages of channel
+// ID, as truncate does.
+type busTruncate struct {
+	ID   string
+	Keep int
+}
+
+// channelState is the access list and mode of a channel.
+type channelState struct {
+	ID   string
+	ACL  *channelACL `json:",omitempty"` // nil for public channels
+	Mode ChannelMode
+}
+
+func stateOf(id string) *channelState {
+	st := &channelState{ID: id, Mode: channelMode(id)}
+	aclMu.Lock()
+	if acl := acls[id]; acl != nil {
+		st.ACL = &channelACL{Owner: acl.Owner, Members: maps.Clone(acl.Members)}
+	}
+	aclMu.Unlock()
+	return st
+}
+
+// shareChannelState sends the access list and mode of channel id to
+// the other instances after they changed.
+func shareChannelState(id string) {
+	bus.PublishStates([]*channelState{stateOf(id)})
+}
+
+// allChannelStates returns the state of every channel that is private
+// or has a mode.
+func allChannelStates() []*channelState {
+	ids := map[string]bool{}
+	aclMu.Lock()
+	for id := range acls {
+		ids[id] = true
+	}
+	aclMu.Unlock()
+	modeMu.Lock()
+	for id := range modes {
+		ids[id] = true
+	}
+	modeMu.Unlock()
+	sts := make([]*channelState, 0, len(ids))
+	for id := range ids {
+		sts = append(sts, stateOf(id))
+	}
+	return sts
+}
+
+// applyChannelState puts the state sent by another instance into
+// effect.
+func applyChannelState(st *channelState) {
+	aclMu.Lock()
+	if st.ACL == nil || st.ACL.Owner == "" {
+		delete(acls, st.ID)
+	} else {
+		if st.ACL.Members == nil {
+			st.ACL.Members = map[string]ChannelRole{}
+		}
+		acls[st.ID] = st.ACL
+	}
+	aclMu.Unlock()
+
+	modeMu.Lock()
+	if st.Mode == ModeAlways {
+		delete(modes, st.ID)
+	} else {
+		modes[st.ID] = st.Mode
+	}
+	modeMu.Unlock()
+}
+
+// redisBus shares messages through Redis PUBLISH and SUBSCRIBE, or any
+// server speaking that part of the Redis protocol. Messages published
+// while an instance is disconnected are lost to it.
+type redisBus struct {
+	addr, password, channel string
+	instance                string
+
+	queue chan []byte        // encoded envelopes to publish
+	stop  context.CancelFunc // stops subscribeLoop
+	wg    sync.WaitGroup
+
+	mu     sync.Mutex // guards following
+	sub    net.Conn
+	closed bool // queue is closed
+}
+
+func (b *redisBus) Publish(msg *Message) {
+	b.enqueue(&busEnvelope{Message: msg}, msg.ID)
+}
+
+func (b *redisBus) PublishStates(sts []*channelState) {
+	b.enqueue(&busEnvelope{States: sts}, sts[0].ID)
+}
+
+func (b *redisBus) PublishTruncate(id string, keep int) {
+	b.enqueue(&busEnvelope{Truncate: &busTruncate{ID: id, Keep: keep}}, id)
+}
+
+// enqueue queues env for publishLoop; id names a channel it is about,
+// for logging.
+func (b *redisBus) enqueue(env *busEnvelope, id string) {
+	env.Instance = b.instance
+	p, err := json.Marshal(env)
+	if err != nil {
+		slog.Error("bus: cannot marshal message", "err", err)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.queue <- p:
+	default:
+		busDropped.Add(1, "queue_full")
+		slog.Warn("bus: queue full, message dropped", "channel", id)
+	}
+}
+
+func (b *redisBus) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.stop()
+	if b.sub != nil {
+		b.sub.Close()
+	}
+	close(b.queue)
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		slog.Warn("bus: messages left unpublished")
+	}
+	return nil
+}
+
+func (b *redisBus) dial(ctx context.Context) (*respConn, error) {
+	d := net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	nc, err := d.DialContext(ctx, "tcp", b.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &respConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if b.password != "" {
+		if _, err := c.do("AUTH", b.password); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("bus: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// publishLoop publishes queued envelopes in order until the queue is
+// closed, reconnecting once per envelope if the connection fails.
+func (b *redisBus) publishLoop(c *respConn) {
+	defer b.wg.Done()
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+	for p := range b.queue {
+		for attempt := 0; ; attempt++ {
+			var err error
+			if c == nil {
+				c, err = b.dial(context.Background())
+			}
+			if err == nil {
+				_, err = c.do("PUBLISH", b.channel, string(p))
+				if err == nil {
+					busMessages.Add(1, "sent")
+					break
+				}
+				c.Close()
+				c = nil
+			}
+			if attempt == 1 {
+				busDropped.Add(1, "publish_failed")
+				slog.Error("bus: cannot publish", "err", err)
+				break
+			}
+		}
+	}
+}
+
+// subscribeLoop receives the messages of other instances, reconnecting
+// with backoff until the bus is closed.
+func (b *redisBus) subscribeLoop(ctx context.Context) {
+	defer b.wg.Done()
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := b.subscribe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > time.Minute {
+			delay = time.Second
+		}
+		slog.Error("bus: subscription lost", "err", err, "retry", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, 30*time.Second)
+	}
+}
+
+func (b *redisBus) subscribe(ctx context.Context) error {
+	c, err := b.dial(ctx)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	if ctx.Err() != nil { // closed while dialing
+		b.mu.Unlock()
+		c.Close()
+		return nil
+	}
+	b.sub = c
+	b.mu.Unlock()
+	defer c.Close()
+
+	if err := c.send("SUBSCRIBE", b.channel); err != nil {
+		return err
+	}
+	slog.Info("bus: subscribed", "addr", b.addr, "channel", b.channel, "instance", b.instance)
+	for {
+		v, err := c.read()
+		if err != nil {
+			return err
+		}
+		// Pushed messages are ["message", channel, payload]; the
+		// subscription is confirmed with ["subscribe", channel, count].
+		a, ok := v.([]any)
+		if !ok || len(a) != 3 {
+			continue
+		}
+		if a[0] == "subscribe" {
+			// Catch up on the channels made private or given a mode
+			// while this instance wasn't listening.
+			b.enqueue(&busEnvelope{Sync: true}, "")
+			continue
+		}
+		if a[0] != "message" {
+			continue
+		}
+		p, _ := a[2].(string)
+		var env busEnvelope
+		if err := json.Unmarshal([]byte(p), &env); err != nil {
+			slog.Warn("bus: invalid message", "err", err)
+			continue
+		}
+		if env.Instance == b.instance {
+			continue
+		}
+		switch {
+		case env.Message != nil:
+			busMessages.Add(1, "received")
+			receive(env.Message)
+		case len(env.States) > 0:
+			for _, st := range env.States {
+				if st != nil && st.ID != "" {
+					applyChannelState(st)
+				}
+			}
+		case env.Truncate != nil && env.Truncate.ID != "" && env.Truncate.Keep >= 0:
+			truncate(env.Truncate.ID, env.Truncate.Keep)
+		case env.Sync:
+			if sts := allChannelStates(); len(sts) > 0 {
+				b.PublishStates(sts)
+			}
+		default:
+			slog.Warn("bus: invalid message", "instance", env.Instance)
+		}
+	}
+}
+
+// respConn is a connection speaking the Redis serialization protocol.
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// send writes a command.
+func (c *respConn) send(args ...string) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return c.w.Flush()
+}
+
+// do sends a command and reads its reply.
+func (c *respConn) do(args ...string) (any, error) {
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	defer c.SetDeadline(time.Time{})
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	v, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := v.(respError); ok {
+		return nil, e
+	}
+	return v, nil
+}
+
+type respError string
+
+func (e respError) Error() string { return string(e) }
+
+// read reads a reply: a string, an int64, a respError, nil or a slice
+// of those.
+func (c *respConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("bus: malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return respError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		a := make([]any, n)
+		for i := range a {
+			if a[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("bus: unexpected reply type %q", kind)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go4.org/types"
+)
+
+// fakeRedis speaks the SUBSCRIBE and PUBLISH commands of the Redis
+// protocol, which is all redisBus needs.
+type fakeRedis struct {
+	l net.Listener
+
+	mu   sync.Mutex // guards subs
+	subs map[string][]*fakeRedisConn
+}
+
+type fakeRedisConn struct {
+	*respConn
+	mu sync.Mutex // serializes writes
+}
+
+func (c *fakeRedisConn) write(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.WriteString(s)
+	c.w.Flush()
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{l: l, subs: map[string][]*fakeRedisConn{}}
+	t.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		nc, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(nc)
+	}
+}
+
+func (s *fakeRedis) handle(nc net.Conn) {
+	c := &fakeRedisConn{respConn: &respConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}}
+	defer nc.Close()
+	defer s.unsubscribe(c)
+
+	for {
+		v, err := c.read()
+		if err != nil {
+			return
+		}
+		args, _ := v.([]any)
+		if len(args) == 0 {
+			c.write("-ERR expected a command\r\n")
+			continue
+		}
+		name, _ := args[0].(string)
+		switch strings.ToUpper(name) {
+		case "SUBSCRIBE":
+			for i, ch := range args[1:] {
+				ch, _ := ch.(string)
+				s.mu.Lock()
+				s.subs[ch] = append(s.subs[ch], c)
+				s.mu.Unlock()
+				c.write(fmt.Sprintf("*3\r\n%s%s:%d\r\n", bulk("subscribe"), bulk(ch), i+1))
+			}
+		case "PUBLISH":
+			if len(args) != 3 {
+				c.write("-ERR wrong number of arguments\r\n")
+				continue
+			}
+			ch, _ := args[1].(string)
+			msg, _ := args[2].(string)
+			s.mu.Lock()
+			subs := slices.Clone(s.subs[ch])
+			s.mu.Unlock()
+			for _, sub := range subs {
+				sub.write("*3\r\n" + bulk("message") + bulk(ch) + bulk(msg))
+			}
+			c.write(fmt.Sprintf(":%d\r\n", len(subs)))
+		default:
+			c.write("-ERR unknown command\r\n")
+		}
+	}
+}
+
+func (s *fakeRedis) unsubscribe(c *fakeRedisConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch, subs := range s.subs {
+		s.subs[ch] = slices.DeleteFunc(subs, func(sub *fakeRedisConn) bool { return sub == c })
+	}
+}
+
+func (s *fakeRedis) subscribers(ch string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subs[ch])
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func bodies(id string) []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var out []string
+	for _, mj := range recent[id] {
+		out = append(out, mj.Body)
+	}
+	return out
+}
+
+func TestRedisBus(t *testing.T) {
+	s := newFakeRedis(t)
+	url := "redis://" + s.l.Addr().String()
+
+	a, err := OpenBus(url, "burp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := OpenBus(url, "burp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	waitFor(t, "subscriptions", func() bool { return s.subscribers("burp") == 2 })
+
+	// Publish on the bus only, so that the messages reach the store
+	// through receive alone.
+	const id = "bustest"
+	truncate(id, 0)
+	t.Cleanup(func() { truncate(id, 0) })
+	send := func(bus Bus, body string) {
+		bus.Publish(&Message{ID: id, Body: body, Role: UserMessage, Time: types.Time3339(time.Now())})
+	}
+
+	// Each instance handles the bus in order, so once a message of the
+	// other instance arrives, its own earlier message was skipped; had
+	// it been echoed, it would be in the store twice.
+	send(a, "one")
+	waitFor(t, "one from a", func() bool { return slices.Equal(bodies(id), []string{"one"}) })
+	send(b, "two")
+	waitFor(t, "two from b", func() bool { return slices.Equal(bodies(id), []string{"one", "two"}) })
+	send(a, "three")
+	waitFor(t, "three from a", func() bool { return slices.Equal(bodies(id), []string{"one", "two", "three"}) })
+
+	// Purges reach the other instance.
+	a.PublishTruncate(id, 1)
+	waitFor(t, "truncate from a", func() bool { return slices.Equal(bodies(id), []string{"three"}) })
+}
+
+// dialFake connects to s like a redisBus does.
+func dialFake(t *testing.T, s *fakeRedis) *respConn {
+	t.Helper()
+	nc, err := net.Dial("tcp", s.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	return &respConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+}
+
+func publishEnvelope(t *testing.T, c *respConn, env busEnvelope) {
+	t.Helper()
+	p, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.do("PUBLISH", "burp", string(p)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisBusChannelState(t *testing.T) {
+	const id = "busstate"
+	reset := func() { applyChannelState(&channelState{ID: id}) }
+	reset()
+	t.Cleanup(reset)
+
+	s := newFakeRedis(t)
+	url := "redis://" + s.l.Addr().String()
+	a, err := OpenBus(url, "burp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	waitFor(t, "subscription", func() bool { return s.subscribers("burp") == 1 })
+
+	// A change made on another instance is put into effect.
+	peer := dialFake(t, s)
+	publishEnvelope(t, peer, busEnvelope{Instance: "peer", States: []*channelState{{
+		ID:   id,
+		ACL:  &channelACL{Owner: "alice", Members: map[string]ChannelRole{"bob": RoleRead}},
+		Mode: ModeMention,
+	}}})
+	waitFor(t, "private channel", func() bool {
+		return channelRole(id, "bob") == RoleRead && channelRole(id, "eve") == RoleNone && channelMode(id) == ModeMention
+	})
+
+	// A new instance asks for the state of all channels when it
+	// subscribes, and a answers.
+	watch := dialFake(t, s)
+	if err := watch.send("SUBSCRIBE", "burp"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "watcher", func() bool { return s.subscribers("burp") == 2 })
+	b, err := OpenBus(url, "burp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// The watcher sees b ask, then a answer with the state above.
+	watch.SetDeadline(time.Now().Add(5 * time.Second))
+	newcomer := b.(*redisBus).instance
+	var asked, answered bool
+	for !answered {
+		v, err := watch.read()
+		if err != nil {
+			t.Fatalf("waiting for sync (asked: %v): %v", asked, err)
+		}
+		m, _ := v.([]any)
+		if len(m) != 3 || m[0] != "message" {
+			continue
+		}
+		var env busEnvelope
+		if err := json.Unmarshal([]byte(m[2].(string)), &env); err != nil {
+			t.Fatal(err)
+		}
+		if env.Sync && env.Instance == newcomer {
+			asked = true
+		}
+		for _, st := range env.States {
+			if st.ID == id && st.ACL != nil && st.ACL.Owner == "alice" && st.Mode == ModeMention {
+				if !asked {
+					t.Fatal("state sent before the new instance asked for it")
+				}
+				answered = env.Instance == a.(*redisBus).instance
+			}
+		}
+	}
+
+	// Releasing the channel elsewhere makes it public again.
+	publishEnvelope(t, peer, busEnvelope{Instance: "peer", States: []*channelState{{ID: id}}})
+	waitFor(t, "public channel", func() bool {
+		return channelRole(id, "eve") == RoleWrite && channelMode(id) == ModeAlways
+	})
+}
@@ -1,85 +1,371 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	_ "embed"
-	"log"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	anthropic "github.com/anthropics/anthropic-sdk-go"
 	"github.com/openai/openai-go/v2"
 	"github.com/tetsuo/bbq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Worker struct {
+	blobs  *BlobStore // nil disables attachments
+	health *Health
+
+	quit context.Context // cancels generations when a drain times out
+	stop context.CancelFunc
+
+	mu sync.Mutex // guards following and adding to wg
 	oc *openai.Client
 	ac *anthropic.Client
+	// fallbacks lists the models to try when a model fails.
+	fallbacks map[ChatModel][]ChatModel
+	draining  bool
+	wg        sync.WaitGroup // running generations
+	gens      map[uint64]*generation
+	lastGen   uint64
 }
 
 func NewWorker(oc *openai.Client, ac *anthropic.Client) *Worker {
-	return &Worker{oc: oc, ac: ac}
+	quit, stop := context.WithCancel(context.Background())
+	return &Worker{
+		oc:     oc,
+		ac:     ac,
+		health: NewHealth(),
+		quit:   quit,
+		stop:   stop,
+		gens:   make(map[uint64]*generation),
+	}
+}
+
+// generation describes a running Send.
+type generation struct {
+	ID        uint64
+	Channel   string
+	Model     ChatModel // as requested
+	RequestID string    `json:",omitempty"`
+	Started   time.Time
+	cancel    context.CancelFunc
+}
+
+// track registers a generation so that it can be listed and cancelled.
+func (w *Worker) track(ctx context.Context, id string, model ChatModel, cancel context.CancelFunc) *generation {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastGen++
+	g := &generation{
+		ID:        w.lastGen,
+		Channel:   id,
+		Model:     model,
+		RequestID: requestIDFrom(ctx),
+		Started:   time.Now(),
+		cancel:    cancel,
+	}
+	w.gens[g.ID] = g
+	return g
+}
+
+func (w *Worker) untrack(g *generation) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.gens, g.ID)
+}
+
+// Generations returns the running generations, oldest first.
+func (w *Worker) Generations() []generation {
+	w.mu.Lock()
+	list := make([]generation, 0, len(w.gens))
+	for _, g := range w.gens {
+		list = append(list, *g)
+	}
+	w.mu.Unlock()
+	slices.SortFunc(list, func(a, b generation) int { return cmp.Compare(a.ID, b.ID) })
+	return list
+}
+
+// Cancel cancels the running generations for which match reports true
+// and returns how many it cancelled. Each still publishes what it
+// generated so far.
+func (w *Worker) Cancel(match func(*generation) bool) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := 0
+	for _, g := range w.gens {
+		if match(g) {
+			g.cancel()
+			n++
+		}
+	}
+	return n
+}
+
+// Configure replaces the provider clients and fallbacks. Running
+// generations keep using the old ones.
+func (w *Worker) Configure(oc *openai.Client, ac *anthropic.Client, fallbacks map[ChatModel][]ChatModel) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.oc, w.ac, w.fallbacks = oc, ac, fallbacks
+}
+
+// clients returns the provider clients, nil for providers that aren't
+// configured.
+func (w *Worker) clients() (*openai.Client, *anthropic.Client) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.oc, w.ac
+}
+
+// chain returns model followed by its fallbacks.
+func (w *Worker) chain(model ChatModel) []ChatModel {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]ChatModel{model}, w.fallbacks[model]...)
+}
+
+// Draining reports whether the worker has stopped taking generations.
+func (w *Worker) Draining() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.draining
+}
+
+// begin registers a generation, reporting false if the worker is
+// draining.
+func (w *Worker) begin() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.draining {
+		return false
+	}
+	w.wg.Add(1)
+	return true
+}
+
+// Drain stops new generations and waits for running ones to finish.
+// Those still running when ctx is done are cancelled.
+func (w *Worker) Drain(ctx context.Context) {
+	w.mu.Lock()
+	w.draining = true
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("cancelling unfinished generations")
+		w.stop()
+		<-done
+	}
 }
 
 //go:embed prompt.md
 var systemMsg string
 
-func (w *Worker) Send(ctx context.Context, id, userMsg string, model ChatModel, extras messageParams) {
-	q := bbq.New[string](16)
+// Usage reports the token counts of a generation.
+type Usage struct {
+	Model        ChatModel // the model that answered
+	InputTokens  int64
+	OutputTokens int64
+	// FirstToken is when the first output was produced; zero if there
+	// was none.
+	FirstToken time.Time
+}
 
-	go func(q *bbq.BBQ[string]) {
-		switch providerFor[model] {
-		case ChatProviderOpenAI:
-			if w.oc == nil {
-				log.Println("warn: openai not configured; aborting message")
-				q.Close()
-				return
-			}
-			w.streamOpenAI(ctx, id, model, extras, q)
-		case ChatProviderAnthropic:
-			if w.ac == nil {
-				log.Println("warn: anthropic not configured; aborting message")
-				q.Close()
-				return
-			}
-			w.streamAnthropic(ctx, id, model, extras, q)
-		default:
-			log.Println("warn: unrecognized model; aborting message")
-			q.Close()
+func (u *Usage) start() {
+	if u.FirstToken.IsZero() {
+		u.FirstToken = time.Now()
+	}
+}
+
+// chunk is a piece of streamed output. Text is batched into assistant
+// messages, or thinking messages if thinking is set; other messages,
+// like tool calls, are published as they are. A chunk with model set
+// switches the model following messages are attributed to.
+type chunk struct {
+	text     string
+	thinking bool
+	msg      *Message
+	model    ChatModel
+}
+
+// errDraining refuses generations while the worker is draining.
+var errDraining = errors.New("server shutting down")
+
+// Send streams a reply to the channel and blocks until the final
+// terminator message has been published. It returns the usage and the
+// text of the reply. If model fails before answering, its fallbacks may
+// answer instead; the returned usage names the model that did. If the
+// worker is draining, Send publishes nothing and returns errDraining.
+func (w *Worker) Send(ctx context.Context, id, userMsg string, model ChatModel, extras messageParams) (Usage, string, error) {
+	if !w.begin() {
+		return Usage{Model: model}, "", errDraining
+	}
+	usage, reply := w.send(ctx, id, userMsg, model, extras)
+	return usage, reply, nil
+}
+
+// Start is like Send, but streams the reply in the background and calls
+// done with its usage and text. It returns once the generation is
+// registered, so that a refusal can be reported to the caller.
+func (w *Worker) Start(ctx context.Context, id, userMsg string, model ChatModel, extras messageParams, done func(Usage, string)) error {
+	if !w.begin() {
+		return errDraining
+	}
+	go func() {
+		done(w.send(ctx, id, userMsg, model, extras))
+	}()
+	return nil
+}
+
+// send implements Send once begin succeeded.
+func (w *Worker) send(ctx context.Context, id, userMsg string, model ChatModel, extras messageParams) (Usage, string) {
+	defer w.wg.Done()
+
+	if extras.System == "" {
+		extras.System, _ = personaPrompt("")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(w.quit, cancel)()
+	defer w.untrack(w.track(ctx, id, model, cancel))
+
+	q := bbq.New[chunk](16)
+
+	start := time.Now()
+	generationsInFlight.Add(1)
+	defer generationsInFlight.Add(-1)
+
+	ctx, span := tracer.Start(ctx, "generate", trace.WithAttributes(
+		attribute.String("burp.channel", id),
+		attribute.String("gen_ai.request.model", string(model)),
+	))
+	defer span.End()
+
+	var usage Usage
+	done := make(chan struct{})
+
+	go func(q *bbq.BBQ[chunk]) {
+		defer close(done)
+		defer q.Close()
+
+		usage = w.generate(ctx, id, model, extras, q)
+	}(q)
+
+	var (
+		text     strings.Builder
+		thinking bool            // whether text holds thinking
+		reply    strings.Builder // whole reply, without thinking
+	)
+	flush := func() {
+		body := text.String()
+		text.Reset()
+		if len(strings.TrimSpace(body)) == 0 {
 			return
 		}
-	}(q)
+		role := AssistantMessage
+		if thinking {
+			role = ThinkingMessage
+		}
+		publishContext(ctx, &Message{
+			ID:    id,
+			Role:  role,
+			Body:  body,
+			Model: model,
+		})
+	}
 
-	// Batcher: publish chunks and final empty-string terminator:
-	go func(q *bbq.BBQ[string]) {
-		// emit a batch when either 10 tokens is reached, or 5 seconds have passed
-		for batch := range q.SlicesWhen(10, time.Second*5) {
-			if len(batch) < 1 {
+	// Batcher: publish chunks and final empty-string terminator.
+	// Emit a batch when either 10 tokens is reached, or 5 seconds have passed.
+	for batch := range q.SlicesWhen(10, time.Second*5) {
+		for _, c := range batch {
+			if c.model != "" {
+				model = c.model
 				continue
 			}
-			body := strings.Join(batch, "")
-			if len(strings.TrimSpace(body)) == 0 {
+			if c.msg == nil {
+				if c.thinking != thinking {
+					flush()
+					thinking = c.thinking
+				}
+				text.WriteString(c.text)
+				if !c.thinking {
+					reply.WriteString(c.text)
+				}
 				continue
 			}
-			publish(&Message{
-				ID:    id,
-				Role:  AssistantMessage,
-				Body:  body,
-				Model: model,
-			})
+			// keep text and other messages in order
+			flush()
+			c.msg.ID = id
+			c.msg.Model = model
+			publishContext(ctx, c.msg)
 		}
-		// empty-string terminator
-		publish(&Message{
-			ID:    id,
-			Role:  AssistantMessage,
-			Body:  "",
-			Model: model,
-		})
-	}(q)
+		flush()
+	}
+	<-done
+	observeGeneration(start, usage)
+	span.SetAttributes(
+		attribute.String("gen_ai.response.model", string(usage.Model)),
+		attribute.Int64("gen_ai.usage.input_tokens", usage.InputTokens),
+		attribute.Int64("gen_ai.usage.output_tokens", usage.OutputTokens),
+	)
+
+	attrs := []any{
+		"channel", id,
+		"model", usage.Model,
+		"duration", time.Since(start),
+		"input_tokens", usage.InputTokens,
+		"output_tokens", usage.OutputTokens,
+	}
+	if !usage.FirstToken.IsZero() {
+		attrs = append(attrs, "time_to_first_token", usage.FirstToken.Sub(start))
+	}
+	if usage.Model != model {
+		attrs = append(attrs, "requested_model", model)
+	}
+	slog.InfoContext(ctx, "generation", attrs...)
+
+	// empty-string terminator
+	term := &Message{
+		ID:    id,
+		Role:  AssistantMessage,
+		Body:  "",
+		Model: model,
+	}
+	if extras.ResponseFormat != nil {
+		err := validateJSON(extras.ResponseFormat, reply.String())
+		valid := err == nil
+		term.SchemaValid = &valid
+		if err != nil {
+			term.SchemaError = err.Error()
+		}
+	}
+	publishContext(ctx, term)
+	return usage, reply.String()
 }
 
 // snapshotHistory copies recent messages for a channel.
-func snapshotHistory(id string, max int) []*Message {
+func snapshotHistory(ctx context.Context, id string, max int) []*Message {
+	_, span := tracer.Start(ctx, "snapshotHistory")
+	defer span.End()
+
 	mu.Lock()
 	list := recent[id]
 	// copy to avoid races
@@ -97,21 +383,124 @@ func snapshotHistory(id string, max int) []*Message {
 	out := make([]*Message, 0, len(cp)-start)
 	for _, msg := range cp[start:] {
 		if msg.LongPollTimeout ||
-			msg.Body == "" ||
+			msg.Body == "" && len(msg.Attachments) == 0 ||
 			msg.Role != UserMessage && msg.Role != AssistantMessage {
 			continue
 		}
 		out = append(out, msg)
 	}
+	span.SetAttributes(attribute.Int("burp.messages", len(out)))
 	return out
 }
 
-func historyToOpenAI(msgs []*Message) []openai.ChatCompletionMessageParamUnion {
+// multipleAuthors reports whether more than one user speaks in msgs.
+func multipleAuthors(msgs []*Message) bool {
+	first := ""
+	seen := false
+	for _, msg := range msgs {
+		if msg.Role != UserMessage {
+			continue
+		}
+		if !seen {
+			first, seen = msg.Author, true
+		} else if msg.Author != first {
+			return true
+		}
+	}
+	return false
+}
+
+// userTurn returns the text of a user message as sent to the model. In
+// multi-user channels it is prefixed with the author's nickname.
+func userTurn(msg *Message, multi bool) string {
+	if !multi {
+		return msg.Body
+	}
+	author := msg.Author
+	if author == "" {
+		author = "anon"
+	}
+	return author + ": " + msg.Body
+}
+
+// attachmentData returns the base64 contents of a for a model with
+// capabilities caps. It reports false if the model can't take it or
+// the contents are gone.
+func (w *Worker) attachmentData(a *Attachment, caps ModelCap) (string, bool) {
+	if w.blobs == nil || caps&attachmentCaps[a.Type] == 0 {
+		return "", false
+	}
+	b, err := w.blobs.Get(a.Hash)
+	if err != nil {
+		slog.Warn("attachment unavailable", "hash", a.Hash, "err", err)
+		return "", false
+	}
+	return base64.StdEncoding.EncodeToString(b), true
+}
+
+// attachmentPlaceholder stands in for attachments a model can't see.
+func attachmentPlaceholder(a *Attachment, why string) string {
+	return fmt.Sprintf("[attachment %s (%s) %s]", a.Name, a.Type, why)
+}
+
+// maxInlineBytes bounds the attachment contents sent with one request,
+// which would otherwise resend every attachment in the history on each
+// turn. One upload always fits.
+const maxInlineBytes = maxUploadBytes
+
+// inlineAttachments picks the attachments of msgs that a model with
+// capabilities caps is sent in full: the newest ones, up to
+// maxInlineBytes. The others are only named.
+func inlineAttachments(msgs []*Message, caps ModelCap) map[*Attachment]bool {
+	inline := map[*Attachment]bool{}
+	var n int64
+	for i := len(msgs) - 1; i >= 0; i-- {
+		for _, a := range msgs[i].Attachments {
+			if caps&attachmentCaps[a.Type] != 0 && n+a.Size <= maxInlineBytes {
+				inline[a] = true
+				n += a.Size
+			}
+		}
+	}
+	return inline
+}
+
+func (w *Worker) historyToOpenAI(msgs []*Message, caps ModelCap) []openai.ChatCompletionMessageParamUnion {
+	multi := multipleAuthors(msgs)
+	inline := inlineAttachments(msgs, caps)
 	p := make([]openai.ChatCompletionMessageParamUnion, 0, len(msgs))
 	for _, msg := range msgs {
 		switch msg.Role {
 		case UserMessage:
-			p = append(p, openai.UserMessage(msg.Body))
+			if len(msg.Attachments) == 0 {
+				p = append(p, openai.UserMessage(userTurn(msg, multi)))
+				continue
+			}
+			parts := make([]openai.ChatCompletionContentPartUnionParam, 0, len(msg.Attachments)+1)
+			for _, a := range msg.Attachments {
+				if !inline[a] && caps&attachmentCaps[a.Type] != 0 {
+					parts = append(parts, openai.TextContentPart(attachmentPlaceholder(a, "sent earlier")))
+					continue
+				}
+				data, ok := w.attachmentData(a, caps)
+				switch {
+				case !ok:
+					parts = append(parts, openai.TextContentPart(attachmentPlaceholder(a, "not available")))
+				case attachmentCaps[a.Type] == CapPDF:
+					parts = append(parts, openai.FileContentPart(openai.ChatCompletionContentPartFileFileParam{
+						FileData: openai.String("data:" + a.Type + ";base64," + data),
+						Filename: openai.String(a.Name),
+					}))
+				default:
+					parts = append(parts, openai.ImageContentPart(openai.ChatCompletionContentPartImageImageURLParam{
+						URL: "data:" + a.Type + ";base64," + data,
+					}))
+				}
+			}
+			if msg.Body != "" {
+				parts = append(parts, openai.TextContentPart(userTurn(msg, multi)))
+			}
+			p = append(p, openai.UserMessage(parts))
 		case AssistantMessage:
 			p = append(p, openai.AssistantMessage(msg.Body))
 		}
@@ -119,57 +508,198 @@ func historyToOpenAI(msgs []*Message) []openai.ChatCompletionMessageParamUnion {
 	return p
 }
 
-func (w *Worker) streamOpenAI(ctx context.Context, id string, model ChatModel, extraParams messageParams, q *bbq.BBQ[string]) {
+func (w *Worker) streamOpenAI(ctx context.Context, oc *openai.Client, id string, model ChatModel, extraParams messageParams, q *bbq.BBQ[chunk]) (usage Usage, err error) {
 	// pull last entries
-	hist := snapshotHistory(id, keepMin)
+	hist := snapshotHistory(ctx, id, config().Retention.KeepMin)
 
 	msgs := []openai.ChatCompletionMessageParamUnion{
-		openai.SystemMessage(systemMsg),
+		openai.SystemMessage(extraParams.System),
 	}
-	msgs = append(msgs, historyToOpenAI(hist)...)
+	msgs = append(msgs, w.historyToOpenAI(hist, modelCaps[model])...)
 
 	params := openai.ChatCompletionNewParams{
 		Model:               openai.ChatModel(model),
 		Messages:            msgs,
 		MaxCompletionTokens: openai.Int(extraParams.MaxTokens),
-		Temperature:         openai.Float(extraParams.Temperature),
+		StreamOptions: openai.ChatCompletionStreamOptionsParam{
+			IncludeUsage: openai.Bool(true),
+		},
+	}
+
+	if extraParams.Temperature != nil {
+		params.Temperature = openai.Float(*extraParams.Temperature)
 	}
 
 	if extraParams.TopP != nil {
 		params.TopP = openai.Float(*extraParams.TopP)
 	}
 
-	stream := w.oc.Chat.Completions.NewStreaming(ctx, params)
-	defer stream.Close()
+	if extraParams.PresencePenalty != nil {
+		params.PresencePenalty = openai.Float(*extraParams.PresencePenalty)
+	}
+
+	if extraParams.FrequencyPenalty != nil {
+		params.FrequencyPenalty = openai.Float(*extraParams.FrequencyPenalty)
+	}
+
+	if extraParams.Seed != nil {
+		params.Seed = openai.Int(*extraParams.Seed)
+	}
 
-	for stream.Next() {
-		q.Write(stream.Current().Choices[0].Delta.Content)
+	if len(extraParams.Stop) > 0 {
+		params.Stop.OfStringArray = extraParams.Stop
 	}
-	if err := stream.Err(); err != nil {
-		log.Printf("error: streamOpenAI: %v\n", err)
+
+	if extraParams.ResponseFormat != nil {
+		var schema map[string]any
+		json.Unmarshal(extraParams.ResponseFormat, &schema)
+		params.ResponseFormat.OfJSONSchema = &openai.ResponseFormatJSONSchemaParam{
+			JSONSchema: openai.ResponseFormatJSONSchemaJSONSchemaParam{
+				Name:   "response",
+				Schema: schema,
+			},
+		}
+		// Strict mode guarantees a matching reply, but only supports
+		// a subset of JSON Schema.
+		if strictSchema(extraParams.ResponseFormat) {
+			params.ResponseFormat.OfJSONSchema.JSONSchema.Strict = openai.Bool(true)
+		}
+	}
+
+	if extraParams.ReasoningEffort != "" {
+		params.ReasoningEffort = openai.ReasoningEffort(extraParams.ReasoningEffort)
+	}
+
+	if len(extraParams.Tools) > 0 {
+		params.Tools = toolsToOpenAI(extraParams.Tools)
+	}
+
+	for round := 0; ; round++ {
+		stream := oc.Chat.Completions.NewStreaming(ctx, params)
+
+		var acc openai.ChatCompletionAccumulator
+		for stream.Next() {
+			c := stream.Current()
+			acc.AddChunk(c)
+			if len(c.Choices) > 0 && c.Choices[0].Delta.Content != "" {
+				q.Write(chunk{text: c.Choices[0].Delta.Content})
+				usage.start()
+			}
+			// the last chunk carries usage and no choices
+			if c.Usage.TotalTokens > 0 {
+				usage.InputTokens += c.Usage.PromptTokens
+				usage.OutputTokens += c.Usage.CompletionTokens
+				// Chat completions don't expose the reasoning itself.
+				if n := c.Usage.CompletionTokensDetails.ReasoningTokens; n > 0 {
+					q.Write(chunk{msg: &Message{Role: ThinkingMessage, Body: fmt.Sprintf("reasoned for %d tokens", n)}})
+					usage.start()
+				}
+			}
+		}
+		err = stream.Err()
+		stream.Close()
+		if err != nil {
+			if round == 0 && usage.FirstToken.IsZero() {
+				return usage, err
+			}
+			return usage, &partialError{err}
+		}
+
+		if len(acc.Choices) == 0 || len(acc.Choices[0].Message.ToolCalls) == 0 {
+			return
+		}
+		if round == maxToolRounds {
+			slog.WarnContext(ctx, "giving up on tool calls", "channel", id, "model", model, "rounds", round)
+			return
+		}
+
+		// The accumulated tool calls lack raw JSON, so ToParam can't be
+		// used to echo them back.
+		reply := acc.Choices[0].Message
+		asst := openai.ChatCompletionAssistantMessageParam{}
+		if reply.Content != "" {
+			asst.Content.OfString = openai.String(reply.Content)
+		}
+		for _, call := range reply.ToolCalls {
+			asst.ToolCalls = append(asst.ToolCalls, openai.ChatCompletionMessageToolCallUnionParam{
+				OfFunction: &openai.ChatCompletionMessageFunctionToolCallParam{
+					ID: call.ID,
+					Function: openai.ChatCompletionMessageFunctionToolCallFunctionParam{
+						Name:      call.Function.Name,
+						Arguments: call.Function.Arguments,
+					},
+				},
+			})
+		}
+		params.Messages = append(params.Messages, openai.ChatCompletionMessageParamUnion{OfAssistant: &asst})
+
+		for _, call := range reply.ToolCalls {
+			result, _ := runTool(ctx, extraParams.Tools, q, call.ID, call.Function.Name, call.Function.Arguments)
+			params.Messages = append(params.Messages, openai.ToolMessage(result, call.ID))
+		}
 	}
-	q.Close()
 }
 
-func (w *Worker) streamAnthropic(ctx context.Context, id string, model ChatModel, extras messageParams, q *bbq.BBQ[string]) {
+// userBlocksAnthropic converts a user message and its attachments to
+// content blocks, sending those in inline in full. Attachments come
+// first, as Anthropic recommends.
+func (w *Worker) userBlocksAnthropic(msg *Message, multi bool, caps ModelCap, inline map[*Attachment]bool) []anthropic.ContentBlockParamUnion {
+	blocks := make([]anthropic.ContentBlockParamUnion, 0, len(msg.Attachments)+1)
+	for _, a := range msg.Attachments {
+		if !inline[a] && caps&attachmentCaps[a.Type] != 0 {
+			blocks = append(blocks, anthropic.NewTextBlock(attachmentPlaceholder(a, "sent earlier")))
+			continue
+		}
+		data, ok := w.attachmentData(a, caps)
+		switch {
+		case !ok:
+			blocks = append(blocks, anthropic.NewTextBlock(attachmentPlaceholder(a, "not available")))
+		case attachmentCaps[a.Type] == CapPDF:
+			doc := anthropic.NewDocumentBlock(anthropic.Base64PDFSourceParam{Data: data})
+			doc.OfDocument.Title = anthropic.String(a.Name)
+			blocks = append(blocks, doc)
+		default:
+			blocks = append(blocks, anthropic.NewImageBlockBase64(a.Type, data))
+		}
+	}
+	if msg.Body != "" || len(blocks) == 0 {
+		blocks = append(blocks, anthropic.NewTextBlock(userTurn(msg, multi)))
+	}
+	return blocks
+}
+
+func (w *Worker) streamAnthropic(ctx context.Context, ac *anthropic.Client, id string, model ChatModel, extras messageParams, q *bbq.BBQ[chunk]) (usage Usage, err error) {
 	// Convert history to anthropic messages
-	hist := snapshotHistory(id, keepMin)
+	hist := snapshotHistory(ctx, id, config().Retention.KeepMin)
+	multi := multipleAuthors(hist)
+	inline := inlineAttachments(hist, modelCaps[model])
 	msgs := make([]anthropic.MessageParam, 0, len(hist)+1)
 	for _, m := range hist {
 		switch m.Role {
 		case UserMessage:
-			msgs = append(msgs, anthropic.NewUserMessage(anthropic.NewTextBlock(m.Body)))
+			msgs = append(msgs, anthropic.NewUserMessage(w.userBlocksAnthropic(m, multi, modelCaps[model], inline)...))
 		case AssistantMessage:
 			msgs = append(msgs, anthropic.NewAssistantMessage(anthropic.NewTextBlock(m.Body)))
 		}
 	}
 
 	params := anthropic.MessageNewParams{
-		Model:       anthropic.Model(model),
-		MaxTokens:   extras.MaxTokens,
-		Temperature: anthropic.Float(extras.Temperature),
-		Messages:    msgs,
-		System:      []anthropic.TextBlockParam{{Text: systemMsg}},
+		Model:     anthropic.Model(model),
+		MaxTokens: extras.MaxTokens,
+		Messages:  msgs,
+		System:    []anthropic.TextBlockParam{{Text: extras.System}},
+	}
+
+	if extras.Temperature != nil {
+		params.Temperature = anthropic.Float(*extras.Temperature)
+	}
+
+	if len(extras.Stop) > 0 {
+		params.StopSequences = extras.Stop
+	}
+
+	if extras.ThinkingBudget > 0 {
+		params.Thinking = anthropic.ThinkingConfigParamOfEnabled(extras.ThinkingBudget)
 	}
 
 	if extras.TopP != nil {
@@ -180,20 +710,74 @@ func (w *Worker) streamAnthropic(ctx context.Context, id string, model ChatModel
 		params.TopK = anthropic.Int(*extras.TopK)
 	}
 
-	stream := w.ac.Messages.NewStreaming(ctx, params)
-	defer stream.Close()
+	if len(extras.Tools) > 0 {
+		params.Tools = toolsToAnthropic(extras.Tools)
+	}
 
-	for stream.Next() {
-		ev := stream.Current()
-		switch any := ev.AsAny().(type) {
-		case anthropic.ContentBlockDeltaEvent:
-			if td, ok := any.Delta.AsAny().(anthropic.TextDelta); ok {
-				q.Write(td.Text)
+	if extras.ResponseFormat != nil {
+		params.Tools = toolsToAnthropic([]*Tool{{
+			Name:        responseToolName,
+			Description: "Give your final answer as the input of this tool.",
+			Schema:      extras.ResponseFormat,
+		}})
+		params.ToolChoice = anthropic.ToolChoiceParamOfTool(responseToolName)
+	}
+
+	for round := 0; ; round++ {
+		stream := ac.Messages.NewStreaming(ctx, params)
+
+		var acc anthropic.Message
+		for stream.Next() {
+			ev := stream.Current()
+			if err := acc.Accumulate(ev); err != nil {
+				slog.ErrorContext(ctx, "cannot accumulate event", "channel", id, "model", model, "err", err)
+			}
+			switch any := ev.AsAny().(type) {
+			case anthropic.ContentBlockDeltaEvent:
+				switch d := any.Delta.AsAny().(type) {
+				case anthropic.TextDelta:
+					q.Write(chunk{text: d.Text})
+					usage.start()
+				case anthropic.ThinkingDelta:
+					q.Write(chunk{text: d.Thinking, thinking: true})
+					usage.start()
+				case anthropic.InputJSONDelta:
+					// the only tool is the forced response tool
+					if extras.ResponseFormat != nil {
+						q.Write(chunk{text: d.PartialJSON})
+						usage.start()
+					}
+				}
 			}
 		}
+		err = stream.Err()
+		stream.Close()
+		usage.InputTokens += acc.Usage.InputTokens
+		usage.OutputTokens += acc.Usage.OutputTokens
+		if err != nil {
+			if round == 0 && usage.FirstToken.IsZero() {
+				return usage, err
+			}
+			return usage, &partialError{err}
+		}
+
+		if acc.StopReason != anthropic.StopReasonToolUse || extras.ResponseFormat != nil {
+			return
+		}
+		if round == maxToolRounds {
+			slog.WarnContext(ctx, "giving up on tool calls", "channel", id, "model", model, "rounds", round)
+			return
+		}
+
+		params.Messages = append(params.Messages, acc.ToParam())
+
+		var results []anthropic.ContentBlockParamUnion
+		for _, block := range acc.Content {
+			if use, ok := block.AsAny().(anthropic.ToolUseBlock); ok {
+				result, isErr := runTool(ctx, extras.Tools, q, use.ID, use.Name, string(use.Input))
+				results = append(results, anthropic.NewToolResultBlock(use.ID, result, isErr))
+			}
+		}
+		params.Messages = append(params.Messages, anthropic.NewUserMessage(results...))
 	}
-	if err := stream.Err(); err != nil {
-		log.Printf("error: streamAnthropic: %v\n", err)
-	}
-	q.Close()
 }
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	anthropic "github.com/anthropics/anthropic-sdk-go"
+	anthropicoption "github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/openai/openai-go/v2"
+	openaioption "github.com/openai/openai-go/v2/option"
+)
+
+// Config is burp's configuration file. Everything but the listeners
+// (Addr, TLS and Unix) and Bus is applied again when the process
+// receives SIGHUP.
+type Config struct {
+	// Addr is the TCP address to listen on; empty disables TCP.
+	Addr string     `json:"addr,omitempty"`
+	TLS  TLSConfig  `json:"tls,omitempty"` // for Addr
+	Unix UnixConfig `json:"unix,omitempty"`
+	Bus  BusConfig  `json:"bus,omitempty"`
+	// Providers is keyed by provider name ("openai", "anthropic"). A
+	// provider is enabled if it has an API key.
+	Providers map[string]*ProviderConfig `json:"providers,omitempty"`
+	Models    ModelsConfig               `json:"models,omitempty"`
+	Retention RetentionConfig            `json:"retention,omitempty"`
+	CORS      CORSConfig                 `json:"cors,omitempty"`
+	// Limits is keyed by tier name, like the -limits file.
+	Limits map[string]TierLimit `json:"limits,omitempty"`
+	// Admins lists the API key names allowed to use the admin API.
+	Admins []string `json:"admins,omitempty"`
+	// Personas maps names to system prompts, chosen with the persona
+	// parameter of /ask. The "default" persona replaces the built-in
+	// prompt.
+	Personas map[string]string `json:"personas,omitempty"`
+
+	limits map[ModelTier]TierLimit // parsed Limits
+}
+
+// TLSConfig names the certificate files, which are loaded again when
+// they change.
+type TLSConfig struct {
+	Cert string `json:"cert,omitempty"` // PEM certificate chain
+	Key  string `json:"key,omitempty"`
+}
+
+type UnixConfig struct {
+	// Path is the Unix domain socket to listen on; empty disables it.
+	Path string   `json:"path,omitempty"`
+	Mode FileMode `json:"mode,omitempty"` // permissions of the socket
+}
+
+type ProviderConfig struct {
+	APIKey  string `json:"api_key,omitempty"`
+	BaseURL string `json:"base_url,omitempty"` // defaults to the public API
+}
+
+type ModelsConfig struct {
+	// Enabled restricts the models clients may ask; all supported
+	// models of the configured providers are enabled if it is empty.
+	Enabled []ChatModel `json:"enabled,omitempty"`
+	// Fallbacks is laid out like the -fallbacks file.
+	Fallbacks map[ChatModel][]ChatModel `json:"fallbacks,omitempty"`
+}
+
+type RetentionConfig struct {
+	// Messages older than MaxAge are dropped from a channel, but the
+	// last KeepMin messages are always kept and sent to the model.
+	KeepMin int      `json:"keep_min,omitempty"`
+	MaxAge  Duration `json:"max_age,omitempty"`
+	// IdleTimeout drops all messages of channels that weren't
+	// published to or read for that long; 0 keeps them.
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+	// MaxChannels and MaxBytes cap the channels and the total size of
+	// the messages held in memory, dropping the least recently used
+	// channels when exceeded; 0 disables a cap.
+	MaxChannels int `json:"max_channels,omitempty"`
+	MaxBytes    int `json:"max_bytes,omitempty"`
+}
+
+// BusConfig connects instances serving the same channels.
+type BusConfig struct {
+	// URL is a redis:// URL; empty runs a single instance.
+	URL     string `json:"url,omitempty"`
+	Channel string `json:"channel,omitempty"` // Redis channel to share
+}
+
+// CORSConfig is the policy for cross-origin requests from browsers.
+type CORSConfig struct {
+	// Origins lists the origins allowed to make cross-origin
+	// requests, like https://chat.example.com. A leftmost label of *
+	// matches any subdomain; "*" alone allows any origin. Unset, it
+	// allows any origin only when authentication is disabled.
+	Origins []string `json:"origins,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+	Headers []string `json:"headers,omitempty"` // request headers
+	// Credentials allows cookies and Authorization headers; it can't
+	// be combined with "*".
+	Credentials bool `json:"credentials,omitempty"`
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge Duration `json:"max_age,omitempty"`
+}
+
+// Duration is a time.Duration written as a string like "90m" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("duration must be a string like \"1h30m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Addr: "localhost:9042",
+		Unix: UnixConfig{Mode: 0o660},
+		Bus:  BusConfig{Channel: "burp"},
+		Retention: RetentionConfig{
+			KeepMin:     50,
+			MaxAge:      Duration(time.Hour),
+			IdleTimeout: Duration(24 * time.Hour),
+			MaxChannels: 10_000,
+			MaxBytes:    256 << 20,
+		},
+		CORS: CORSConfig{
+			Methods: []string{"GET", "HEAD", "POST"},
+			Headers: []string{"Content-Type", "Authorization", "X-Request-ID"},
+			MaxAge:  Duration(10 * time.Minute),
+		},
+	}
+}
+
+// configEnv maps environment variables to the settings they override.
+var configEnv = []struct {
+	name string
+	set  func(c *Config, v string)
+}{
+	{"BURP_ADDR", func(c *Config, v string) { c.Addr = v }},
+	{"BURP_TLS_CERT", func(c *Config, v string) { c.TLS.Cert = v }},
+	{"BURP_TLS_KEY", func(c *Config, v string) { c.TLS.Key = v }},
+	{"BURP_UNIX", func(c *Config, v string) { c.Unix.Path = v }},
+	{"BURP_BUS", func(c *Config, v string) { c.Bus.URL = v }},
+	{"BURP_ADMINS", func(c *Config, v string) { c.Admins = strings.Split(v, ",") }},
+	{"BURP_CORS_ORIGINS", func(c *Config, v string) { c.CORS.Origins = strings.Split(v, ",") }},
+	{"OPENAI_API_KEY", func(c *Config, v string) { c.provider("openai").APIKey = v }},
+	{"OPENAI_BASE_URL", func(c *Config, v string) { c.provider("openai").BaseURL = v }},
+	{"ANTHROPIC_API_KEY", func(c *Config, v string) { c.provider("anthropic").APIKey = v }},
+	{"ANTHROPIC_BASE_URL", func(c *Config, v string) { c.provider("anthropic").BaseURL = v }},
+}
+
+// provider returns the named provider's settings, adding them if
+// they are missing.
+func (c *Config) provider(name string) *ProviderConfig {
+	if c.Providers == nil {
+		c.Providers = make(map[string]*ProviderConfig)
+	}
+	if c.Providers[name] == nil {
+		c.Providers[name] = new(ProviderConfig)
+	}
+	return c.Providers[name]
+}
+
+// LoadConfig reads the configuration file at path, if it isn't empty,
+// over the defaults and applies the environment variables in configEnv
+// and then override, if it isn't nil, on top of it.
+func LoadConfig(path string, override func(*Config) error) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.DisallowUnknownFields()
+		if err := d.Decode(c); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, e := range configEnv {
+		if v := os.Getenv(e.name); v != "" {
+			e.set(c, v)
+		}
+	}
+	if override != nil {
+		if err := override(c); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.check(); err != nil {
+		if path != "" {
+			err = fmt.Errorf("%s: %v", path, err)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) check() error {
+	if c.Addr == "" && c.Unix.Path == "" {
+		return errors.New("no addr or unix socket to listen on")
+	}
+	if c.Bus.URL != "" && c.Bus.Channel == "" {
+		return errors.New("bus needs a channel")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("tls needs both cert and key")
+	}
+	enabled := false
+	for name, p := range c.Providers {
+		if !slices.Contains([]string{"openai", "anthropic"}, name) {
+			return fmt.Errorf("unknown provider %q", name)
+		}
+		enabled = enabled || p != nil && p.APIKey != ""
+	}
+	if !enabled {
+		return errors.New("no provider has an API key; set OPENAI_API_KEY or ANTHROPIC_API_KEY")
+	}
+	for _, m := range c.Models.Enabled {
+		if providerFor[m] == 0 {
+			return fmt.Errorf("unsupported model %q", m)
+		}
+	}
+	if err := checkFallbacks(c.Models.Fallbacks); err != nil {
+		return err
+	}
+	if c.Retention.KeepMin < 1 || c.Retention.MaxAge <= 0 {
+		return errors.New("retention needs a positive keep_min and max_age")
+	}
+	if c.Retention.IdleTimeout < 0 || c.Retention.MaxChannels < 0 || c.Retention.MaxBytes < 0 {
+		return errors.New("retention limits can't be negative")
+	}
+	if err := c.CORS.check(); err != nil {
+		return err
+	}
+	if c.limits == nil { // not set by -limits
+		limits, err := parseTierLimits(c.Limits)
+		if err != nil {
+			return err
+		}
+		c.limits = limits
+	}
+	for _, name := range c.Admins {
+		if !isNonEmptyAlnum(name) {
+			return fmt.Errorf("admin %q must be an alphanumeric key name", name)
+		}
+	}
+	for name, prompt := range c.Personas {
+		if name == "" || strings.TrimSpace(prompt) == "" {
+			return fmt.Errorf("persona %q needs a name and a prompt", name)
+		}
+	}
+	return nil
+}
+
+var currentConfig atomic.Pointer[Config]
+
+func init() {
+	currentConfig.Store(defaultConfig())
+}
+
+// config returns the configuration in effect. It must not be modified.
+func config() *Config {
+	return currentConfig.Load()
+}
+
+// modelEnabled reports whether clients may ask model.
+func modelEnabled(model ChatModel) bool {
+	enabled := config().Models.Enabled
+	return len(enabled) == 0 || slices.Contains(enabled, model)
+}
+
+// personaPrompt returns the system prompt of the named persona; an
+// empty name selects the default.
+func personaPrompt(name string) (string, bool) {
+	personas := config().Personas
+	if name == "" {
+		if p, ok := personas["default"]; ok {
+			return p, true
+		}
+		return systemMsg, true
+	}
+	p, ok := personas[name]
+	return p, ok
+}
+
+// applyConfig puts cfg into effect, except for the listeners and the
+// bus.
+func (s *Server) applyConfig(cfg *Config) {
+	var ac *anthropic.Client
+	if p := cfg.Providers["anthropic"]; p != nil && p.APIKey != "" {
+		// Worker retries failed generations itself.
+		opts := []anthropicoption.RequestOption{anthropicoption.WithAPIKey(p.APIKey), anthropicoption.WithMaxRetries(0)}
+		if p.BaseURL != "" {
+			opts = append(opts, anthropicoption.WithBaseURL(p.BaseURL))
+		}
+		c := anthropic.NewClient(opts...)
+		ac = &c
+		slog.Info("enabling anthropic models")
+	}
+
+	var oc *openai.Client
+	if p := cfg.Providers["openai"]; p != nil && p.APIKey != "" {
+		opts := []openaioption.RequestOption{openaioption.WithAPIKey(p.APIKey), openaioption.WithMaxRetries(0)}
+		if p.BaseURL != "" {
+			opts = append(opts, openaioption.WithBaseURL(p.BaseURL))
+		}
+		c := openai.NewClient(opts...)
+		oc = &c
+		slog.Info("enabling openai models")
+	}
+
+	s.wkr.Configure(oc, ac, cfg.Models.Fallbacks)
+	s.lim.SetLimits(cfg.limits)
+	currentConfig.Store(cfg)
+}
@@ -1,21 +1,137 @@
 package main
 
-import "net/http"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
 
+// check validates the policy and canonicalizes its methods and headers.
+func (c *CORSConfig) check() error {
+	for _, o := range c.Origins {
+		if o == "*" {
+			if c.Credentials {
+				return errors.New("cors: credentials can't be allowed for any origin")
+			}
+			continue
+		}
+		scheme, host, ok := strings.Cut(o, "://")
+		if !ok || scheme == "" || host == "" || strings.Contains(host, "/") {
+			return fmt.Errorf("cors: origin %q must look like scheme://host[:port]", o)
+		}
+		if strings.Contains(scheme, "*") ||
+			strings.Count(host, "*") > 1 ||
+			strings.Contains(host, "*") && !strings.HasPrefix(host, "*.") {
+			return fmt.Errorf("cors: origin %q may only use * as its leftmost label", o)
+		}
+	}
+	for i, m := range c.Methods {
+		c.Methods[i] = strings.ToUpper(strings.TrimSpace(m))
+	}
+	for i, h := range c.Headers {
+		c.Headers[i] = http.CanonicalHeaderKey(strings.TrimSpace(h))
+	}
+	if c.MaxAge < 0 {
+		return errors.New("cors: negative max_age")
+	}
+	return nil
+}
+
+// allowOrigin reports whether origin may make cross-origin requests.
+// Patterns like https://*.example.com match any subdomain.
+func (c *CORSConfig) allowOrigin(origin string) bool {
+	for _, o := range c.Origins {
+		if o == "*" || o == origin {
+			return true
+		}
+		prefix, suffix, ok := strings.Cut(o, "*")
+		if ok && len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+			!strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowPreflight reports why a preflight request for method and the
+// comma-separated headers is refused, or "" if it's allowed.
+func (c *CORSConfig) allowPreflight(method, headers string) string {
+	if !slices.Contains(c.Methods, method) {
+		return "method not allowed"
+	}
+	for h := range strings.SplitSeq(headers, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !slices.Contains(c.Headers, http.CanonicalHeaderKey(h)) {
+			return "header not allowed: " + h
+		}
+	}
+	return ""
+}
+
+// corsHandler applies the CORS policy of the configuration in effect.
+// Preflight requests are answered here; requests from origins that
+// aren't allowed are served without CORS headers, so browsers hide the
+// response.
 func corsHandler(next http.Handler) http.Handler {
-	const (
-		allowOrigin  = "*"
-		allowMethods = "GET, HEAD, POST, OPTIONS"
-		allowHeaders = "Content-Type"
-	)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
-		w.Header().Set("Access-Control-Allow-Methods", allowMethods)
-		w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
+		c := &config().CORS
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && origin != "" &&
+			r.Header.Get("Access-Control-Request-Method") != ""
+
+		h := w.Header()
+		anyOrigin := slices.Contains(c.Origins, "*")
+		if !anyOrigin {
+			// The response depends on the origin, so caches must
+			// not share it between origins.
+			h.Add("Vary", "Origin")
+		}
+		allowed := origin != "" && c.allowOrigin(origin)
+		if allowed {
+			if anyOrigin {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if c.Credentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if !preflight {
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
 			return
 		}
-		next.ServeHTTP(w, r)
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		if !allowed {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		reqHeaders := r.Header.Get("Access-Control-Request-Headers")
+		if reason := c.allowPreflight(r.Header.Get("Access-Control-Request-Method"), reqHeaders); reason != "" {
+			h.Del("Access-Control-Allow-Origin")
+			h.Del("Access-Control-Allow-Credentials")
+			http.Error(w, reason, http.StatusForbidden)
+			return
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ", "))
+		if len(c.Headers) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ", "))
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(c.MaxAge)/time.Second)))
+		}
+		w.WriteHeader(http.StatusNoContent)
 	})
 }
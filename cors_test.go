@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+func TestCORSAllowOrigin(t *testing.T) {
+	c := &CORSConfig{Origins: []string{
+		"https://chat.example.com",
+		"https://*.example.org",
+		"http://localhost:8080",
+	}}
+	if err := c.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://chat.example.com", true},
+		{"https://www.example.com", false},
+		{"http://chat.example.com", false},       // scheme mismatch
+		{"https://chat.example.com:8443", false}, // port mismatch
+
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},       // * needs a label
+		{"https://.example.org", false},      // an empty one doesn't do
+		{"http://a.example.org", false},      // scheme mismatch
+		{"https://a.example.org:443", false}, // port mismatch
+		{"https://evilexample.org", false},
+		{"https://a.example.org.evil.com", false},
+		{"https://evil.com/x.example.org", false},
+		{"https://evil.com:1.example.org", false},
+
+		{"http://localhost:8080", true},
+		{"http://localhost", false},
+		{"http://localhost:8081", false},
+		{"https://localhost:8080", false},
+
+		{"", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := c.allowOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+
+	c = &CORSConfig{Origins: []string{"*"}}
+	if !c.allowOrigin("https://anything.example") {
+		t.Error(`"*" refused an origin`)
+	}
+}
+
+func TestCORSCheck(t *testing.T) {
+	tests := []struct {
+		cfg CORSConfig
+		ok  bool
+	}{
+		{CORSConfig{Origins: []string{"https://*.example.org"}}, true},
+		{CORSConfig{Origins: []string{"*"}}, true},
+		{CORSConfig{Origins: []string{"*"}, Credentials: true}, false},
+		{CORSConfig{Origins: []string{"example.org"}}, false},
+		{CORSConfig{Origins: []string{"https://example.org/"}}, false},
+		{CORSConfig{Origins: []string{"https://a.*.example.org"}}, false},
+		{CORSConfig{Origins: []string{"https://*.*.example.org"}}, false},
+		{CORSConfig{Origins: []string{"*://example.org"}}, false},
+		{CORSConfig{MaxAge: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.check(); (err == nil) != tt.ok {
+			t.Errorf("check(%+v) = %v, want ok %v", tt.cfg, err, tt.ok)
+		}
+	}
+}
+
+func TestCORSAllowPreflight(t *testing.T) {
+	c := defaultConfig().CORS
+	c.Methods = append(c.Methods, " put ")
+	if err := c.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, headers string
+		ok              bool
+	}{
+		{"GET", "", true},
+		{"POST", "content-type", true},
+		{"POST", "Content-Type, authorization ,X-Request-Id", true},
+		{"POST", "Content-Type,,", true},
+		{"PUT", "", true},
+		{"DELETE", "", false},
+		{"post", "", false}, // methods are case-sensitive
+		{"POST", "X-Custom", false},
+		{"POST", "Content-Type, Cookie", false},
+	}
+	for _, tt := range tests {
+		if reason := c.allowPreflight(tt.method, tt.headers); (reason == "") != tt.ok {
+			t.Errorf("allowPreflight(%q, %q) = %q, want ok %v", tt.method, tt.headers, reason, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// swept is when idle channels were last evicted; guarded by mu.
+var swept time.Time
+
+// evictLocked drops idle channels, at most once a minute, and then the
+// least recently used channels while the store holds more channels or
+// bytes than the retention settings allow. The channel keep, which was
+// just used, is never dropped. Access lists and modes are kept, so
+// evicted private channels stay private.
+//
+// Must be called with mu held.
+func evictLocked(keep string) {
+	r := config().Retention
+
+	if r.IdleTimeout > 0 && time.Since(swept) >= time.Minute {
+		swept = time.Now()
+		cutoff := swept.Add(-time.Duration(r.IdleTimeout))
+		for id, t := range used {
+			if id != keep && t.Before(cutoff) && len(waiting[id]) == 0 {
+				dropLocked(id, "idle")
+			}
+		}
+	}
+
+	over := func(frac float64) string {
+		switch {
+		case r.MaxChannels > 0 && float64(len(recent)) > frac*float64(r.MaxChannels):
+			return "channels"
+		case r.MaxBytes > 0 && float64(stored) > frac*float64(r.MaxBytes):
+			return "bytes"
+		}
+		return ""
+	}
+	if over(1) == "" {
+		return
+	}
+
+	// Evict down to 90% of the caps, so that a busy store doesn't sort
+	// its channels on every message.
+	ids := make([]string, 0, len(recent))
+	for id := range recent {
+		if id != keep {
+			ids = append(ids, id)
+		}
+	}
+	slices.SortFunc(ids, func(a, b string) int { return used[a].Compare(used[b]) })
+	for _, id := range ids {
+		reason := over(0.9)
+		if reason == "" {
+			break
+		}
+		dropLocked(id, reason)
+	}
+}
+
+// dropLocked removes the messages of channel id from memory.
+//
+// Must be called with mu held.
+func dropLocked(id, reason string) {
+	n := listBytes(recent[id])
+	stored -= n
+	delete(recent, id)
+	delete(used, id)
+	channelEvictions.Add(1, reason)
+	evictedBytes.Add(float64(n), reason)
+}
+
+// evictEveryMinute runs evictLocked every minute until ctx is done, so
+// that idle channels are dropped while nothing is published.
+func evictEveryMinute(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		mu.Lock()
+		evictLocked("")
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	anthropic "github.com/anthropics/anthropic-sdk-go"
+	"github.com/openai/openai-go/v2"
+	"github.com/tetsuo/bbq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	maxRetries     = 3
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 8 * time.Second
+)
+
+// LoadFallbacks reads a JSON object mapping a model to the models to try,
+// in order, when it fails before producing any output.
+func LoadFallbacks(path string) (map[ChatModel][]ChatModel, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[ChatModel][]ChatModel
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := checkFallbacks(m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+func checkFallbacks(m map[ChatModel][]ChatModel) error {
+	for model, chain := range m {
+		if providerFor[model] == 0 {
+			return fmt.Errorf("unsupported model %q", model)
+		}
+		for _, fb := range chain {
+			if providerFor[fb] == 0 {
+				return fmt.Errorf("%s: unsupported fallback %q", model, fb)
+			}
+			if fb == model {
+				return fmt.Errorf("%s falls back to itself", model)
+			}
+		}
+	}
+	return nil
+}
+
+// generate streams a reply from model. Errors before any output are
+// retried with backoff if they are transient, after which the model's
+// fallbacks are tried in turn; errors after some output end the reply.
+// The returned usage names the model that answered.
+func (w *Worker) generate(ctx context.Context, id string, model ChatModel, extras messageParams, q *bbq.BBQ[chunk]) (usage Usage) {
+	usage.Model = model
+
+	chain := w.chain(model)
+	for i, m := range chain {
+		params := extras
+		if i > 0 {
+			var ok bool
+			if params, ok = fallbackParams(extras, m); !ok {
+				slog.WarnContext(ctx, "skipping fallback that can't honor the request", "channel", id, "model", m)
+				continue
+			}
+		}
+
+		for attempt := 0; ; attempt++ {
+			if !w.health.Allow(m) {
+				slog.WarnContext(ctx, "circuit breaker open", "channel", id, "model", m)
+				break
+			}
+			if m != usage.Model {
+				slog.WarnContext(ctx, "falling back", "channel", id, "model", m, "from", usage.Model)
+				q.Write(chunk{model: m})
+				usage.Model = m
+			}
+
+			start := time.Now()
+			sctx, span := tracer.Start(ctx, "chat "+string(m), trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+				attribute.String("gen_ai.system", providerNames[providerFor[m]]),
+				attribute.String("gen_ai.request.model", string(m)),
+				attribute.Int("burp.attempt", attempt+1),
+			))
+			u, err := w.stream(sctx, id, m, params, q)
+			span.SetAttributes(
+				attribute.Int64("gen_ai.usage.input_tokens", u.InputTokens),
+				attribute.Int64("gen_ai.usage.output_tokens", u.OutputTokens),
+			)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "generation failed")
+			}
+			span.End()
+			w.health.Record(m, time.Since(start), err)
+			usage.InputTokens += u.InputTokens
+			usage.OutputTokens += u.OutputTokens
+			if err == nil {
+				usage.FirstToken = u.FirstToken
+				return
+			}
+			observeProviderError(m, err)
+			attrs := []any{"channel", id, "model", m, "duration", time.Since(start), "err", err}
+			var pe *partialError
+			if errors.As(err, &pe) {
+				usage.FirstToken = u.FirstToken
+				slog.ErrorContext(ctx, "generation failed after partial output", attrs...)
+				return
+			}
+			if ctx.Err() != nil {
+				slog.ErrorContext(ctx, "generation failed", attrs...)
+				return
+			}
+			if !retryable(err) || attempt == maxRetries {
+				slog.ErrorContext(ctx, "generation failed", attrs...)
+				break
+			}
+			d := retryDelay(err, attempt)
+			slog.WarnContext(ctx, "retrying generation", append(attrs, "attempt", attempt+1, "delay", d)...)
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	return
+}
+
+// Available reports whether model or one of its fallbacks may be sent a
+// generation. Otherwise it returns how long until one may.
+func (w *Worker) Available(model ChatModel) (time.Duration, bool) {
+	wait := breakerCooldown
+	for _, m := range w.chain(model) {
+		d, ok := w.health.Available(m)
+		if ok {
+			return 0, true
+		}
+		wait = min(wait, d)
+	}
+	return wait, false
+}
+
+// partialError is the error of a generation that failed after writing
+// output, which can't be retried without repeating it.
+type partialError struct{ err error }
+
+func (e *partialError) Error() string { return e.err.Error() }
+func (e *partialError) Unwrap() error { return e.err }
+
+// stream generates a reply from model. If the generation fails after
+// writing to q, the error is a *partialError.
+func (w *Worker) stream(ctx context.Context, id string, model ChatModel, extras messageParams, q *bbq.BBQ[chunk]) (Usage, error) {
+	oc, ac := w.clients()
+	switch providerFor[model] {
+	case ChatProviderOpenAI:
+		if oc == nil {
+			return Usage{}, errors.New("openai not configured")
+		}
+		return w.streamOpenAI(ctx, oc, id, model, extras, q)
+	case ChatProviderAnthropic:
+		if ac == nil {
+			return Usage{}, errors.New("anthropic not configured")
+		}
+		return w.streamAnthropic(ctx, ac, id, model, extras, q)
+	default:
+		return Usage{}, errors.New("unrecognized model")
+	}
+}
+
+// retryable reports whether err is worth retrying: rate limits,
+// overloads, server errors and failed connections. Anything else, like
+// a bad request or an error of burp itself, is not.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var oe *openai.Error
+	if errors.As(err, &oe) {
+		return retryableStatus(oe.StatusCode)
+	}
+	var ae *anthropic.Error
+	if errors.As(err, &ae) {
+		return retryableStatus(ae.StatusCode)
+	}
+	// Errors sent in the event stream carry only the error body.
+	s := err.Error()
+	if strings.Contains(s, "received error while streaming") {
+		for _, typ := range []string{"overloaded_error", "rate_limit_error", "api_error", "server_error"} {
+			if strings.Contains(s, typ) {
+				return true
+			}
+		}
+		return false
+	}
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout ||
+		code == http.StatusConflict ||
+		code == http.StatusTooManyRequests ||
+		code >= 500 // including Anthropic's 529 overloaded
+}
+
+// retryDelay returns how long to wait before retry attempt+1: the
+// provider's Retry-After if given, otherwise exponential backoff with
+// jitter.
+func retryDelay(err error, attempt int) time.Duration {
+	var resp *http.Response
+	var oe *openai.Error
+	var ae *anthropic.Error
+	if errors.As(err, &oe) {
+		resp = oe.Response
+	} else if errors.As(err, &ae) {
+		resp = ae.Response
+	}
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+			return min(time.Duration(secs)*time.Second, retryMaxDelay)
+		}
+	}
+
+	d := min(retryBaseDelay<<attempt, retryMaxDelay)
+	return d/2 + rand.N(d/2)
+}
+
+// fallbackParams adapts params parsed for another model to model,
+// dropping what it doesn't support. It reports false if model can't
+// serve the request at all, because it lacks tools or structured output.
+func fallbackParams(params messageParams, model ChatModel) (messageParams, bool) {
+	caps := modelCaps[model]
+	provider := providerFor[model]
+
+	if len(params.Tools) > 0 && caps&CapTools == 0 {
+		return params, false
+	}
+	if params.ResponseFormat != nil {
+		if caps&CapJSONSchema == 0 || provider == ChatProviderAnthropic && len(params.Tools) > 0 {
+			return params, false
+		}
+	}
+
+	if limit := modelMaxOutputTokens[model]; params.MaxTokens > limit {
+		params.MaxTokens = limit
+	}
+
+	switch provider {
+	case ChatProviderOpenAI:
+		params.TopK = nil
+		params.ThinkingBudget = 0
+		if caps&CapReasoning != 0 {
+			params.Temperature = nil
+			params.TopP = nil
+			params.PresencePenalty = nil
+			params.FrequencyPenalty = nil
+			params.Stop = nil
+		}
+		if len(params.Stop) > 4 {
+			params.Stop = params.Stop[:4]
+		}
+		if caps&CapReasoningEffort == 0 ||
+			params.ReasoningEffort == "minimal" && !strings.HasPrefix(string(model), "gpt-5") {
+			params.ReasoningEffort = ""
+		}
+	case ChatProviderAnthropic:
+		params.Seed = nil
+		params.PresencePenalty = nil
+		params.FrequencyPenalty = nil
+		params.ReasoningEffort = ""
+		if params.Temperature != nil && *params.Temperature > 1.0 {
+			v := 1.0
+			params.Temperature = &v
+		}
+		if caps&CapThinking == 0 || params.ResponseFormat != nil || params.ThinkingBudget >= params.MaxTokens {
+			params.ThinkingBudget = 0
+		}
+		if params.ThinkingBudget > 0 {
+			params.Temperature = nil
+			params.TopK = nil
+			if params.TopP != nil && *params.TopP < 0.95 {
+				params.TopP = nil
+			}
+		}
+	}
+	return params, true
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// breakerThreshold is the number of consecutive failures that opens
+	// a model's circuit breaker.
+	breakerThreshold = 5
+	// breakerCooldown is how long an open breaker fails fast before a
+	// probe is let through.
+	breakerCooldown = 30 * time.Second
+)
+
+var providerNames = map[ChatProvider]string{
+	ChatProviderOpenAI:    "openai",
+	ChatProviderAnthropic: "anthropic",
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen // one probe may test the model
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Health tracks generation outcomes and latency per model, and keeps a
+// circuit breaker for each so that a failing model is skipped instead
+// of being retried by every request.
+type Health struct {
+	mu     sync.Mutex
+	models map[ChatModel]*modelHealth
+}
+
+type modelHealth struct {
+	state    breakerState
+	failures int // consecutive
+	openedAt time.Time
+	probing  bool // a half-open probe is in flight
+
+	requests  int64
+	errors    int64
+	latency   time.Duration // moving average of successful generations
+	lastError string
+	errorAt   time.Time
+	successAt time.Time
+}
+
+func NewHealth() *Health {
+	return &Health{models: make(map[ChatModel]*modelHealth)}
+}
+
+func (h *Health) modelLocked(model ChatModel) *modelHealth {
+	m := h.models[model]
+	if m == nil {
+		m = &modelHealth{}
+		h.models[model] = m
+	}
+	return m
+}
+
+// Allow reports whether a generation may be sent to model. An open
+// breaker fails fast until its cooldown has passed, then lets a single
+// probe through.
+func (h *Health) Allow(model ChatModel) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	m := h.modelLocked(model)
+	switch m.state {
+	case breakerOpen:
+		if time.Since(m.openedAt) < breakerCooldown {
+			return false
+		}
+		m.state = breakerHalfOpen
+		m.probing = true
+		return true
+	case breakerHalfOpen:
+		if m.probing {
+			return false
+		}
+		m.probing = true
+		return true
+	}
+	return true
+}
+
+// Available reports whether model would be allowed, without taking the
+// half-open probe. Otherwise it returns how long until the next probe.
+func (h *Health) Available(model ChatModel) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	m := h.models[model]
+	if m == nil {
+		return 0, true
+	}
+	switch m.state {
+	case breakerOpen:
+		if wait := breakerCooldown - time.Since(m.openedAt); wait > 0 {
+			return wait, false
+		}
+	case breakerHalfOpen:
+		if m.probing {
+			return time.Second, false
+		}
+	}
+	return 0, true
+}
+
+// Record reports the outcome of a generation by model that took d.
+// Only transient errors count toward the breaker; cancellations and
+// rejected requests don't say anything about the model's health.
+func (h *Health) Record(model ChatModel, d time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	m := h.modelLocked(model)
+	m.probing = false
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	m.requests++
+	now := time.Now()
+	if err == nil {
+		m.state = breakerClosed
+		m.failures = 0
+		m.successAt = now
+		if m.latency == 0 {
+			m.latency = d
+		} else {
+			m.latency = (m.latency*7 + d) / 8
+		}
+		return
+	}
+
+	m.errors++
+	m.lastError = err.Error()
+	m.errorAt = now
+	if !retryable(err) {
+		return
+	}
+	m.failures++
+	if m.state == breakerHalfOpen || m.failures >= breakerThreshold {
+		m.state = breakerOpen
+		m.openedAt = now
+	}
+}
+
+// ModelHealth is the health of a model as reported by
+// /healthz/providers.
+type ModelHealth struct {
+	Provider            string
+	Breaker             string
+	Requests            int64
+	Errors              int64
+	ConsecutiveFailures int
+	LatencyMs           int64     `json:",omitempty"`
+	LastError           string    `json:",omitempty"`
+	LastErrorAt         time.Time `json:",omitzero"`
+	LastSuccessAt       time.Time `json:",omitzero"`
+}
+
+// ProviderHealth sums up the health of a provider's models. Status is
+// "ok", "degraded" if a model's breaker isn't closed, or "disabled" if
+// the provider isn't configured.
+type ProviderHealth struct {
+	Status   string
+	Requests int64
+	Errors   int64
+}
+
+// serveProviderHealth reports provider and model health.
+func (s *Server) serveProviderHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := struct {
+		Providers map[string]*ProviderHealth
+		Models    map[ChatModel]*ModelHealth
+	}{
+		Providers: map[string]*ProviderHealth{
+			providerNames[ChatProviderOpenAI]:    {Status: "ok"},
+			providerNames[ChatProviderAnthropic]: {Status: "ok"},
+		},
+		Models: make(map[ChatModel]*ModelHealth),
+	}
+	oc, ac := s.wkr.clients()
+	if oc == nil {
+		resp.Providers[providerNames[ChatProviderOpenAI]].Status = "disabled"
+	}
+	if ac == nil {
+		resp.Providers[providerNames[ChatProviderAnthropic]].Status = "disabled"
+	}
+
+	h := s.wkr.health
+	h.mu.Lock()
+	for model, m := range h.models {
+		if m.requests == 0 && m.state == breakerClosed {
+			continue
+		}
+		provider := providerNames[providerFor[model]]
+		resp.Models[model] = &ModelHealth{
+			Provider:            provider,
+			Breaker:             m.state.String(),
+			Requests:            m.requests,
+			Errors:              m.errors,
+			ConsecutiveFailures: m.failures,
+			LatencyMs:           m.latency.Milliseconds(),
+			LastError:           m.lastError,
+			LastErrorAt:         m.errorAt,
+			LastSuccessAt:       m.successAt,
+		}
+		p := resp.Providers[provider]
+		p.Requests += m.requests
+		p.Errors += m.errors
+		if m.state != breakerClosed && p.Status == "ok" {
+			p.Status = "degraded"
+		}
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serviceUnavailable replies 503 with a Retry-After header.
+func serviceUnavailable(w http.ResponseWriter, retryAfter time.Duration, reason string) {
+	retryAfterError(w, http.StatusServiceUnavailable, retryAfter, reason)
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The IRC gateway speaks a small subset of RFC 1459/2812: PASS, NICK,
+// USER, JOIN, PART, PRIVMSG, PING, PONG and QUIT. IRC channels map to
+// burp channel IDs without the leading '#'.
+
+const (
+	ircServerName  = "burp"
+	ircMaxLine     = 8191 // generous; RFC 2812 says 512
+	ircMaxBody     = 400  // bytes of text per outgoing PRIVMSG
+	ircIdleTimeout = 5 * time.Minute
+	ircPingEvery   = 2 * time.Minute
+)
+
+var (
+	ircMu    sync.Mutex              // guards following
+	ircNicks = map[string]*ircConn{} // lowercased nick -> connection
+)
+
+// ServeIRC accepts IRC client connections on l. Replies are generated
+// with model unless it is empty, in which case channels only relay
+// messages between users.
+func (s *Server) ServeIRC(l net.Listener, model ChatModel) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		c := &ircConn{
+			srv:      s,
+			conn:     conn,
+			model:    model,
+			channels: map[string]context.CancelFunc{},
+			pending:  map[string]string{},
+		}
+		go c.serve()
+	}
+}
+
+type ircConn struct {
+	srv   *Server
+	conn  net.Conn
+	model ChatModel
+
+	// registration state; only touched by the serve goroutine
+	pass       string
+	nick       string
+	user       string
+	ident      Identity
+	registered bool
+
+	channels map[string]context.CancelFunc // channel ID -> stop following
+
+	wmu sync.Mutex // serializes writes
+
+	mu      sync.Mutex        // guards following
+	pending map[string]string // channel ID -> unfinished assistant line
+}
+
+type ircMessage struct {
+	command string
+	params  []string
+}
+
+// parseIRCLine splits a raw line into its command and parameters,
+// dropping the optional prefix.
+func parseIRCLine(line string) ircMessage {
+	var m ircMessage
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if strings.HasPrefix(line, ":") {
+			m.params = append(m.params, line[1:])
+			break
+		}
+		var p string
+		p, line, _ = strings.Cut(line, " ")
+		if p == "" {
+			continue
+		}
+		if m.command == "" {
+			m.command = strings.ToUpper(p)
+		} else {
+			m.params = append(m.params, p)
+		}
+	}
+	return m
+}
+
+func (c *ircConn) send(format string, args ...any) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	fmt.Fprintf(c.conn, format+"\r\n", args...)
+}
+
+// reply sends a numeric reply addressed to the client.
+func (c *ircConn) reply(code, format string, args ...any) {
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+	c.send(":%s %s %s "+format, append([]any{ircServerName, code, nick}, args...)...)
+}
+
+func (c *ircConn) serve() {
+	defer c.close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		t := time.NewTicker(ircPingEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				c.send("PING :%s", ircServerName)
+			}
+		}
+	}()
+
+	sc := bufio.NewScanner(c.conn)
+	sc.Buffer(make([]byte, 512), ircMaxLine)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(ircIdleTimeout))
+		if !sc.Scan() {
+			return
+		}
+		m := parseIRCLine(strings.TrimRight(sc.Text(), "\r"))
+		if m.command == "" {
+			continue
+		}
+		if !c.handle(m) {
+			return
+		}
+	}
+}
+
+func (c *ircConn) close() {
+	for _, cancel := range c.channels {
+		cancel()
+	}
+	if c.nick != "" {
+		ircMu.Lock()
+		if ircNicks[strings.ToLower(c.nick)] == c {
+			delete(ircNicks, strings.ToLower(c.nick))
+		}
+		ircMu.Unlock()
+	}
+	c.conn.Close()
+}
+
+// handle processes one client message and reports whether the
+// connection should stay open.
+func (c *ircConn) handle(m ircMessage) bool {
+	switch m.command {
+	case "PING":
+		if len(m.params) < 1 {
+			c.reply("409", ":No origin specified")
+			return true
+		}
+		c.send(":%s PONG %s :%s", ircServerName, ircServerName, m.params[0])
+		return true
+	case "PONG":
+		return true
+	case "QUIT":
+		c.send("ERROR :Closing link")
+		return false
+	case "PASS":
+		if c.registered {
+			c.reply("462", ":You may not reregister")
+		} else if len(m.params) < 1 {
+			c.reply("461", "PASS :Not enough parameters")
+		} else {
+			c.pass = m.params[0]
+		}
+		return true
+	case "NICK":
+		return c.handleNick(m)
+	case "USER":
+		if c.registered {
+			c.reply("462", ":You may not reregister")
+			return true
+		}
+		if len(m.params) < 4 {
+			c.reply("461", "USER :Not enough parameters")
+			return true
+		}
+		c.user = m.params[0]
+		return c.register()
+	}
+
+	if !c.registered {
+		c.reply("451", ":You have not registered")
+		return true
+	}
+
+	switch m.command {
+	case "JOIN":
+		if len(m.params) < 1 {
+			c.reply("461", "JOIN :Not enough parameters")
+			return true
+		}
+		for _, name := range strings.Split(m.params[0], ",") {
+			c.join(name)
+		}
+	case "PART":
+		if len(m.params) < 1 {
+			c.reply("461", "PART :Not enough parameters")
+			return true
+		}
+		for _, name := range strings.Split(m.params[0], ",") {
+			c.part(name)
+		}
+	case "PRIVMSG":
+		if len(m.params) < 1 {
+			c.reply("411", ":No recipient given (PRIVMSG)")
+			return true
+		}
+		if len(m.params) < 2 || m.params[1] == "" {
+			c.reply("412", ":No text to send")
+			return true
+		}
+		c.privmsg(m.params[0], m.params[1])
+	default:
+		c.reply("421", "%s :Unknown command", m.command)
+	}
+	return true
+}
+
+func (c *ircConn) handleNick(m ircMessage) bool {
+	if len(m.params) < 1 {
+		c.reply("431", ":No nickname given")
+		return true
+	}
+	nick := m.params[0]
+	if c.registered {
+		// Nicks are identities here; changing them would break
+		// attribution and ACLs.
+		c.reply("484", ":Your connection is restricted")
+		return true
+	}
+	if validNick(nick) != "" {
+		c.reply("432", "%s :Erroneous nickname", nick)
+		return true
+	}
+
+	ircMu.Lock()
+	other := ircNicks[strings.ToLower(nick)]
+	if other == nil {
+		if c.nick != "" {
+			delete(ircNicks, strings.ToLower(c.nick))
+		}
+		ircNicks[strings.ToLower(nick)] = c
+	}
+	ircMu.Unlock()
+
+	if other != nil && other != c {
+		c.reply("433", "%s :Nickname is already in use", nick)
+		return true
+	}
+	c.nick = nick
+	return c.register()
+}
+
+// register completes the handshake once both NICK and USER were seen,
+// authenticating the PASS credential if authentication is enabled.
+func (c *ircConn) register() bool {
+	if c.nick == "" || c.user == "" {
+		return true
+	}
+
+	if a := c.srv.auth; a != nil {
+		ident, ok := a.check(c.pass)
+		if !ok {
+			c.reply("464", ":Password incorrect")
+			c.send("ERROR :Closing link (authentication required)")
+			return false
+		}
+		if ident.Name != c.nick {
+			c.reply("432", "%s :Nickname must match credentials (%s)", c.nick, ident.Name)
+			c.send("ERROR :Closing link")
+			return false
+		}
+		c.ident = ident
+	}
+
+	c.registered = true
+	c.reply("001", ":Welcome to burp, %s", c.nick)
+	c.reply("002", ":Your host is %s", ircServerName)
+	c.reply("003", ":This server bridges burp channels")
+	c.reply("004", "%s burp o o", ircServerName)
+	c.reply("422", ":MOTD File is missing")
+	return true
+}
+
+// channelID maps an IRC channel name to a burp channel ID.
+func channelID(name string) (string, bool) {
+	id, ok := strings.CutPrefix(name, "#")
+	if !ok || id == "" || len(id) > 32 || !isNonEmptyAlnum(id) {
+		return "", false
+	}
+	return id, true
+}
+
+// allowed reports whether the connection's identity has role need on id.
+func (c *ircConn) allowed(id string, need ChannelRole) bool {
+	if c.srv.auth == nil {
+		return true
+	}
+	if c.ident.Channel != "" && c.ident.Channel != id {
+		return false
+	}
+	return channelRole(id, c.ident.Name) >= need
+}
+
+func (c *ircConn) join(name string) {
+	id, ok := channelID(name)
+	if !ok {
+		c.reply("403", "%s :No such channel", name)
+		return
+	}
+	if _, ok := c.channels[id]; ok {
+		return
+	}
+	if !c.allowed(id, RoleRead) {
+		c.reply("473", "%s :Cannot join channel", name)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.channels[id] = cancel
+
+	c.send(":%s!%s@%s JOIN %s", c.nick, c.user, ircServerName, name)
+	c.reply("331", "%s :No topic is set", name)
+	c.reply("353", "= %s :%s %s", name, c.nick, AssistantName)
+	c.reply("366", "%s :End of /NAMES list", name)
+
+	go c.follow(ctx, id)
+}
+
+func (c *ircConn) part(name string) {
+	id, ok := channelID(name)
+	cancel := c.channels[id]
+	if !ok || cancel == nil {
+		c.reply("442", "%s :You're not on that channel", name)
+		return
+	}
+	cancel()
+	delete(c.channels, id)
+	c.send(":%s!%s@%s PART %s", c.nick, c.user, ircServerName, name)
+}
+
+func (c *ircConn) privmsg(target, text string) {
+	id, ok := channelID(target)
+	if !ok {
+		c.reply("401", "%s :No such nick/channel", target)
+		return
+	}
+	if _, ok := c.channels[id]; !ok {
+		c.reply("404", "%s :Cannot send to channel", target)
+		return
+	}
+	if !c.allowed(id, RoleWrite) {
+		c.reply("404", "%s :Cannot send to channel", target)
+		return
+	}
+
+	reply := c.model != "" && shouldReply(id, text)
+
+	var (
+		model  ChatModel
+		params messageParams
+		client = "ip:" + c.remoteHost()
+	)
+	if c.ident.Name != "" {
+		client = "id:" + c.ident.Name
+	}
+	// Every message takes a request token, like posts to /ask.
+	tier, maxChars := postLimits(c.model)
+	if int64(len(text)) > maxChars {
+		c.send(":%s NOTICE %s :message too long", ircServerName, c.nick)
+		return
+	}
+	if retryAfter, reason := c.srv.lim.AllowRequest(client, tier); reason != "" {
+		c.send(":%s NOTICE %s :%s; retry in %s", ircServerName, c.nick, reason, retryAfter.Round(time.Second))
+		return
+	}
+	if reply && c.srv.wkr.Draining() {
+		c.send(":%s NOTICE %s :server shutting down", ircServerName, c.nick)
+		return
+	}
+	if reply {
+		// Reuse the HTTP validation for the gateway's default model.
+		r, _ := http.NewRequest(http.MethodGet, "/?"+url.Values{
+			"id":    {id},
+			"model": {string(c.model)},
+		}.Encode(), nil)
+		var reason string
+		if _, model, _, params, reason = c.srv.parseRequest(r); reason != "" {
+			c.send(":%s NOTICE %s :%s", ircServerName, c.nick, reason)
+			return
+		}
+		if retryAfter, reason := c.srv.lim.CheckQuota(client, modelTier[model]); reason != "" {
+			c.send(":%s NOTICE %s :%s; retry in %s", ircServerName, c.nick, reason, retryAfter.Round(time.Second))
+			return
+		}
+	}
+
+	publish(&Message{
+		ID:     id,
+		Body:   text,
+		Author: c.nick,
+		Role:   UserMessage,
+	})
+
+	if reply {
+		ctx := withRequestID(context.Background(), newRequestID())
+		err := c.srv.wkr.Start(ctx, id, text, model, params, func(usage Usage, _ string) {
+			c.srv.lim.Charge(client, modelTier[usage.Model], usage.OutputTokens)
+		})
+		if err != nil {
+			c.send(":%s NOTICE %s :%s", ircServerName, c.nick, err)
+		}
+	}
+}
+
+func (c *ircConn) remoteHost() string {
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return c.conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// follow relays messages published to channel id until ctx is done.
+func (c *ircConn) follow(ctx context.Context, id string) {
+	after := time.Now()
+	for {
+		ch := make(chan *messageAndJSON, 1)
+		register(id, ch, after)
+		select {
+		case <-ctx.Done():
+			unregister(id, ch)
+			return
+		case msg := <-ch:
+			unregister(id, ch)
+			if msg.Shutdown {
+				c.send(":%s NOTICE #%s :server shutting down", ircServerName, id)
+				return
+			}
+			after = msg.Time.Time()
+			c.deliver(id, msg.Message)
+		}
+	}
+}
+
+// deliver writes msg to the client as PRIVMSG lines. Assistant replies
+// arrive in chunks, so partial lines are held back until a newline or
+// the empty terminator message arrives.
+func (c *ircConn) deliver(id string, msg *Message) {
+	switch msg.Role {
+	case UserMessage:
+		if msg.Author == c.nick {
+			return // IRC does not echo a client's own messages
+		}
+		author := msg.Author
+		if author == "" {
+			author = "anon"
+		}
+		for _, line := range splitLines(msg.Body) {
+			c.privmsgLine(author, id, line)
+		}
+	case AssistantMessage:
+		c.mu.Lock()
+		lines := splitLines(c.pending[id] + msg.Body)
+		if msg.Body == "" {
+			delete(c.pending, id) // terminator; flush everything
+		} else {
+			c.pending[id] = lines[len(lines)-1]
+			lines = lines[:len(lines)-1]
+		}
+		c.mu.Unlock()
+		for _, line := range lines {
+			c.privmsgLine(AssistantName, id, line)
+		}
+	}
+}
+
+// splitLines splits s at any of the line endings IRC clients and
+// servers accept, so that none ends up inside a protocol line.
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.Split(strings.ReplaceAll(s, "\r", "\n"), "\n")
+}
+
+// stripControl removes C0 control characters, which could end a
+// protocol line or confuse clients; tabs become spaces.
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case r < 0x20 || r == 0x7f:
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// privmsgLine sends one line of text from nick to the channel, split
+// into chunks that fit the IRC line length limit.
+func (c *ircConn) privmsgLine(nick, id, line string) {
+	line = strings.TrimSpace(stripControl(line))
+	for line != "" {
+		n := len(line)
+		if n > ircMaxBody {
+			n = ircMaxBody
+			// don't split UTF-8 sequences
+			for n > 0 && line[n]&0xC0 == 0x80 {
+				n--
+			}
+		}
+		c.send(":%s!%s@%s PRIVMSG #%s :%s", nick, nick, ircServerName, id, line[:n])
+		line = line[n:]
+	}
+}
+
+// defaultIRCModel picks the model used for IRC replies when none is set.
+func defaultIRCModel(w *Worker) ChatModel {
+	oc, ac := w.clients()
+	switch {
+	case ac != nil:
+		return ChatModelClaude3_5HaikuLatest
+	case oc != nil:
+		return ChatModelOpenAIGPT4_1Mini
+	}
+	return ""
+}
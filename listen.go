@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// certReloader serves a TLS certificate, loading it again when its
+// files change so that rotated certificates are picked up without a
+// restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex // guards following
+	cert    *tls.Certificate
+	modTime time.Time // latest of the two files
+	checked time.Time
+}
+
+// certCheckInterval limits how often the files are checked.
+const certCheckInterval = 10 * time.Second
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the certificate if the files changed since it was last
+// read.
+//
+// Must be called with r.mu held, or before r is shared.
+func (r *certReloader) load() error {
+	r.checked = time.Now()
+	var mod time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	if r.cert != nil && mod.Equal(r.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil {
+		slog.Info("reloaded TLS certificate", "cert", r.certFile)
+	}
+	r.cert, r.modTime = &cert, mod
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) >= certCheckInterval {
+		// Keep serving the old certificate while a rotation is half
+		// done or broken.
+		if err := r.load(); err != nil {
+			slog.Error("cannot reload TLS certificate", "cert", r.certFile, "err", err)
+		}
+	}
+	return r.cert, nil
+}
+
+// listenTCP listens on addr, with TLS if cfg has a certificate.
+func listenTCP(addr string, cfg TLSConfig) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Cert == "" {
+		return l, nil
+	}
+	r, err := newCertReloader(cfg.Cert, cfg.Key)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return tls.NewListener(l, &tls.Config{
+		GetCertificate: r.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}), nil
+}
+
+// listenUnix listens on a Unix domain socket at path with the given
+// permissions. A socket left behind by a previous run is removed; the
+// socket is removed again when the listener is closed.
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// FileMode is a file mode written as an octal string like "0660" in
+// JSON.
+type FileMode fs.FileMode
+
+func (m *FileMode) UnmarshalText(b []byte) error {
+	v, err := strconv.ParseUint(string(b), 8, 32)
+	if err != nil || v > 0o777 {
+		return fmt.Errorf("invalid file mode %q", b)
+	}
+	*m = FileMode(v)
+	return nil
+}
+
+func (m FileMode) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%04o", uint32(m))), nil
+}
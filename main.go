@@ -1,51 +1,277 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"log"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-
-	anthropic "github.com/anthropics/anthropic-sdk-go"
-	anthropicoption "github.com/anthropics/anthropic-sdk-go/option"
-	"github.com/openai/openai-go/v2"
-	openaioption "github.com/openai/openai-go/v2/option"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 )
 
-var addrFlag = flag.String("addr", "localhost:9042", "host and port to bind the server to")
+var (
+	configFlag    = flag.String("config", "", "path to a JSON configuration file; reloaded on SIGHUP")
+	addrFlag      = flag.String("addr", "localhost:9042", "host and port to bind the server to, or empty to not listen on TCP; overrides the config file")
+	tlsCertFlag   = flag.String("tls-cert", "", "path to a PEM certificate chain to serve -addr with TLS; reloaded when it changes")
+	tlsKeyFlag    = flag.String("tls-key", "", "path to the PEM private key of -tls-cert")
+	unixFlag      = flag.String("unix", "", "path to a Unix domain socket to also serve on; disabled if empty")
+	unixModeFlag  = flag.String("unix-mode", "0660", "permissions of the -unix socket")
+	busFlag       = flag.String("bus", "", "redis:// URL of a bus shared with other instances serving the same channels; disabled if empty")
+	keysFlag      = flag.String("keys", "", "path to a file of \"<name> <key>\" API key lines; enables authentication")
+	limitsFlag    = flag.String("limits", "", "path to a JSON file of per-tier rate limits and token quotas; overrides the config file")
+	ircFlag       = flag.String("irc", "", "host and port to accept IRC clients on; disabled if empty")
+	ircModel      = flag.String("irc-model", "", "model replying in IRC channels; defaults to a small model of a configured provider")
+	mcpFlag       = flag.String("mcp", "", "path to a JSON file of MCP servers whose tools are offered to the model")
+	blobsFlag     = flag.String("blobs", filepath.Join(os.TempDir(), "burp-blobs"), "directory to store message attachments in")
+	logFormat     = flag.String("log-format", "text", "log output format: text or json")
+	logLevel      = flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	historyFlag   = flag.String("history", "", "path to save recent messages, ACLs and modes to on shutdown and restore them from on startup; disabled if empty")
+	shutdownFlag  = flag.Duration("shutdown-timeout", 30*time.Second, "how long to let replies finish on shutdown before cancelling them")
+	traceFlag     = flag.String("trace", "", "export OpenTelemetry traces to stdout (written to stderr) or otlp; disabled if empty")
+	mcpStdio      = flag.Bool("mcp-stdio", false, "also serve MCP on stdin and stdout, exiting when stdin is closed")
+	fallbacksFlag = flag.String("fallbacks", "", "path to a JSON file mapping models to the models to try when they fail; overrides the config file")
+)
 
 func main() {
-	openaiApiKey := os.Getenv("OPENAI_API_KEY")
-	anthApiKey := os.Getenv("ANTHROPIC_API_KEY")
+	flag.Parse()
 
-	if anthApiKey == "" && openaiApiKey == "" {
-		log.Fatal("you must set either the OPENAI_API_KEY or the ANTHROPIC_API_KEY environment variable")
+	if err := setupLogging(*logFormat, *logLevel); err != nil {
+		fatal("cannot set up logging", "err", err)
 	}
 
-	var ac *anthropic.Client
-	if anthApiKey != "" {
-		c := anthropic.NewClient(anthropicoption.WithAPIKey(anthApiKey))
-		ac = &c
-		log.Print("enabling anthropic models")
+	shutdownTracing, err := setupTracing(context.Background(), *traceFlag)
+	if err != nil {
+		fatal("cannot set up tracing", "err", err)
 	}
 
-	var oc *openai.Client
-	if openaiApiKey != "" {
-		c := openai.NewClient(openaioption.WithAPIKey(openaiApiKey))
-		oc = &c
-		log.Print("enabling openai models")
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("cannot load config", "err", err)
 	}
 
 	server := &Server{
-		wkr: NewWorker(oc, ac),
+		wkr: NewWorker(nil, nil),
+		lim: NewLimiter(cfg.limits),
+	}
+	server.applyConfig(cfg)
+
+	blobs, err := NewBlobStore(*blobsFlag)
+	if err != nil {
+		fatal("cannot open blob store", "err", err)
+	}
+	server.wkr.blobs = blobs
+
+	if *keysFlag != "" {
+		auth, err := LoadAuth(*keysFlag, []byte(os.Getenv("BURP_TOKEN_SECRET")))
+		if err != nil {
+			fatal("cannot load API keys", "err", err)
+		}
+		server.auth = auth
+		slog.Info("enabling authentication", "keys", len(auth.keys))
+	} else {
+		slog.Warn("authentication disabled; set -keys to require API keys")
+	}
+
+	var mcpClients []*mcpClient
+	if *mcpFlag != "" {
+		cfg, err := LoadMCPConfig(*mcpFlag)
+		if err != nil {
+			fatal("cannot load MCP servers", "err", err)
+		}
+		mcpClients = StartMCP(cfg)
+	}
+
+	if *historyFlag != "" {
+		n, err := LoadHistory(*historyFlag)
+		if err != nil {
+			fatal("cannot load history", "err", err)
+		}
+		slog.Info("restored history", "channels", n)
+	}
+
+	if cfg.Bus.URL != "" {
+		b, err := OpenBus(cfg.Bus.URL, cfg.Bus.Channel)
+		if err != nil {
+			fatal("cannot connect to bus", "err", err)
+		}
+		bus = b
 	}
 
 	mux := http.NewServeMux()
 
 	server.Install(mux)
 
-	serverAddr := *addrFlag
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go evictEveryMinute(ctx)
+	go server.wkr.blobs.sweepEvery(ctx, 10*time.Minute)
+
+	var ircListener net.Listener
+	if *ircFlag != "" {
+		model := ChatModel(*ircModel)
+		if model == "" {
+			model = defaultIRCModel(server.wkr)
+		} else if providerFor[model] == 0 || !modelEnabled(model) {
+			fatal("unsupported IRC model", "model", model)
+		}
+		l, err := net.Listen("tcp", *ircFlag)
+		if err != nil {
+			fatal("cannot listen for IRC clients", "err", err)
+		}
+		slog.Info("accepting IRC clients", "addr", l.Addr(), "model", model)
+		ircListener = l
+		go func() {
+			if err := server.ServeIRC(l, model); !errors.Is(err, net.ErrClosed) {
+				fatal("IRC gateway stopped", "err", err)
+			}
+		}()
+	}
+
+	if *mcpStdio {
+		go func() {
+			if err := server.ServeMCPStdio(os.Stdin, os.Stdout); err != nil {
+				fatal("mcp: stdio failed", "err", err)
+			}
+			slog.Info("mcp: stdin closed")
+			stop()
+		}()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			cfg, err := loadConfig()
+			if err != nil {
+				slog.Error("cannot reload config", "err", err)
+				continue
+			}
+			if old := config(); cfg.Addr != old.Addr || cfg.TLS != old.TLS || cfg.Unix != old.Unix || cfg.Bus != old.Bus {
+				slog.Warn("restart to change the listeners or the bus")
+				cfg.Addr, cfg.TLS, cfg.Unix, cfg.Bus = old.Addr, old.TLS, old.Unix, old.Bus
+			}
+			server.applyConfig(cfg)
+			slog.Info("reloaded config")
+		}
+	}()
+
+	// Time out slow clients, but leave a 32 MB upload a few minutes.
+	// WriteTimeout stays unset, so that long polls and slow downloads
+	// are not cut off.
+	srv := &http.Server{
+		Handler:           corsHandler(requestIDHandler(mux)),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       5 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	var listeners []net.Listener
+	if cfg.Addr != "" {
+		l, err := listenTCP(cfg.Addr, cfg.TLS)
+		if err != nil {
+			fatal("cannot listen", "err", err)
+		}
+		slog.Info("listening", "addr", l.Addr(), "tls", cfg.TLS.Cert != "")
+		listeners = append(listeners, l)
+	}
+	if cfg.Unix.Path != "" {
+		l, err := listenUnix(cfg.Unix.Path, fs.FileMode(cfg.Unix.Mode))
+		if err != nil {
+			fatal("cannot listen", "err", err)
+		}
+		slog.Info("listening", "unix", cfg.Unix.Path, "mode", cfg.Unix.Mode)
+		listeners = append(listeners, l)
+	}
+	for _, l := range listeners {
+		go func() {
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				fatal("server stopped", "err", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop() // a second signal kills the process
+	slog.Info("shutting down", "timeout", *shutdownFlag)
+
+	// Keep serving /wait and /recent while replies finish, so that
+	// clients receive them in full.
+	drainCtx, cancel := context.WithTimeout(context.Background(), *shutdownFlag)
+	defer cancel()
+	server.wkr.Drain(drainCtx)
+
+	closeWaiters()
+	if ircListener != nil {
+		ircListener.Close()
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("closing connections", "err", err)
+		srv.Close()
+	}
+	for _, c := range mcpClients {
+		c.Close()
+	}
+	// Close the bus last, once nothing is left to publish.
+	bus.Close()
+
+	if *historyFlag != "" {
+		if err := SaveHistory(*historyFlag); err != nil {
+			slog.Error("cannot save history", "err", err)
+		}
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("cannot flush traces", "err", err)
+	}
+	slog.Info("stopped")
+}
 
-	log.Printf("listening on %s", serverAddr)
-	log.Fatal(http.ListenAndServe(serverAddr, corsHandler(mux)))
+// loadConfig reads the -config file and applies the flags set on the
+// command line over it.
+func loadConfig() (*Config, error) {
+	return LoadConfig(*configFlag, func(cfg *Config) (err error) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "addr":
+				cfg.Addr = *addrFlag
+			case "tls-cert":
+				cfg.TLS.Cert = *tlsCertFlag
+			case "tls-key":
+				cfg.TLS.Key = *tlsKeyFlag
+			case "unix":
+				cfg.Unix.Path = *unixFlag
+			case "bus":
+				cfg.Bus.URL = *busFlag
+			case "unix-mode":
+				err = cfg.Unix.Mode.UnmarshalText([]byte(*unixModeFlag))
+			}
+		})
+		if err != nil {
+			return err
+		}
+		// Browsers on other origins must not drive API keys without
+		// being listed explicitly.
+		if cfg.CORS.Origins == nil && *keysFlag == "" {
+			cfg.CORS.Origins = []string{"*"}
+		}
+		if *limitsFlag != "" {
+			if cfg.limits, err = LoadTierLimits(*limitsFlag); err != nil {
+				return err
+			}
+		}
+		if *fallbacksFlag != "" {
+			if cfg.Models.Fallbacks, err = LoadFallbacks(*fallbacksFlag); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
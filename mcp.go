@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MCPConfig lists the Model Context Protocol servers burp launches. The
+// layout follows the "mcpServers" files used by other MCP clients, with
+// an optional list of channels per server.
+type MCPConfig struct {
+	Servers map[string]MCPServerConfig `json:"mcpServers"`
+}
+
+type MCPServerConfig struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	// Channels restricts the server's tools to these channel IDs. The
+	// tools are available in every channel if it is empty.
+	Channels []string `json:"channels,omitempty"`
+}
+
+// LoadMCPConfig reads an MCP server configuration file.
+func LoadMCPConfig(path string) (*MCPConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg MCPConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for name, sc := range cfg.Servers {
+		if !validToolName(name) || strings.Contains(name, "__") {
+			return nil, fmt.Errorf("%s: invalid server name %q", path, name)
+		}
+		if sc.Command == "" {
+			return nil, fmt.Errorf("%s: server %q has no command", path, name)
+		}
+		for _, id := range sc.Channels {
+			if len(id) > 32 || !isNonEmptyAlnum(id) {
+				return nil, fmt.Errorf("%s: server %q: invalid channel %q", path, name, id)
+			}
+		}
+		if len(sc.Channels) == 0 {
+			sc.Channels = nil
+			cfg.Servers[name] = sc
+		}
+	}
+	return &cfg, nil
+}
+
+const mcpCallTimeout = 30 * time.Second
+
+// mcpClient talks JSON-RPC to one MCP server over its stdin and stdout.
+// The process is restarted on demand after it exits.
+type mcpClient struct {
+	name string
+	cfg  MCPServerConfig
+
+	startMu sync.Mutex // serializes restarts
+
+	mu      sync.Mutex // guards following
+	stdin   io.WriteCloser
+	done    chan struct{} // closed when the process has exited
+	nextID  int64
+	pending map[int64]chan *rpcMessage
+}
+
+// StartMCP launches the configured servers and registers their tools
+// as "<server>__<tool>". Servers that fail to start are logged and
+// skipped.
+func StartMCP(cfg *MCPConfig) []*mcpClient {
+	var clients []*mcpClient
+	for name, sc := range cfg.Servers {
+		c := &mcpClient{name: name, cfg: sc}
+		if err := c.start(); err != nil {
+			slog.Error("mcp: cannot start server", "server", name, "err", err)
+			continue
+		}
+		if err := c.refreshTools(); err != nil {
+			slog.Error("mcp: tools/list failed", "server", name, "err", err)
+		}
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (c *mcpClient) start() error {
+	cmd := exec.Command(c.cfg.Command, c.cfg.Args...)
+	cmd.Env = os.Environ()
+	for k, v := range c.cfg.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+
+	c.mu.Lock()
+	c.stdin = stdin
+	c.done = done
+	c.pending = map[int64]chan *rpcMessage{}
+	c.mu.Unlock()
+
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			slog.Info("mcp: stderr", "server", c.name, "line", sc.Text())
+		}
+	}()
+
+	go func() {
+		c.readLoop(stdout)
+		err := cmd.Wait()
+		slog.Warn("mcp: server exited", "server", c.name, "err", err)
+
+		c.mu.Lock()
+		for _, ch := range c.pending {
+			close(ch)
+		}
+		c.pending = nil
+		c.mu.Unlock()
+		close(done)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mcpCallTimeout)
+	defer cancel()
+
+	var res struct {
+		ProtocolVersion string `json:"protocolVersion"`
+	}
+	err = c.call(ctx, "initialize", map[string]any{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": "burp", "version": "1"},
+	}, &res)
+	if err != nil {
+		stdin.Close()
+		return fmt.Errorf("initialize: %v", err)
+	}
+	return c.notify("notifications/initialized", nil)
+}
+
+// ensure restarts the server if its process has exited.
+func (c *mcpClient) ensure() error {
+	c.startMu.Lock()
+	defer c.startMu.Unlock()
+
+	c.mu.Lock()
+	done := c.done
+	c.mu.Unlock()
+	select {
+	case <-done:
+		return c.start()
+	default:
+		return nil
+	}
+}
+
+func (c *mcpClient) readLoop(r io.Reader) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var m rpcMessage
+			if err := json.Unmarshal(line, &m); err != nil {
+				slog.Warn("mcp: bad message", "server", c.name, "err", err)
+			} else {
+				c.dispatch(&m)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *mcpClient) dispatch(m *rpcMessage) {
+	if m.Method == "" {
+		// a response to one of our calls
+		id, err := strconv.ParseInt(string(m.ID), 10, 64)
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- m
+		}
+		return
+	}
+
+	switch m.Method {
+	case "notifications/tools/list_changed":
+		go func() {
+			if err := c.refreshTools(); err != nil {
+				slog.Error("mcp: tools/list failed", "server", c.name, "err", err)
+			}
+		}()
+	case "ping":
+		c.write(&rpcMessage{JSONRPC: "2.0", ID: m.ID, Result: json.RawMessage("{}")})
+	default:
+		if m.ID != nil {
+			c.write(&rpcMessage{JSONRPC: "2.0", ID: m.ID, Error: &rpcError{Code: rpcMethodNotFound, Message: "method not found"}})
+		}
+	}
+}
+
+func (c *mcpClient) write(m *rpcMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.stdin.Write(append(b, '\n'))
+	return err
+}
+
+func (c *mcpClient) notify(method string, params any) error {
+	m := &rpcMessage{JSONRPC: "2.0", Method: method}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		m.Params = b
+	}
+	return c.write(m)
+}
+
+// call sends a request and decodes its result into out.
+func (c *mcpClient) call(ctx context.Context, method string, params, out any) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *rpcMessage, 1)
+
+	c.mu.Lock()
+	if c.pending == nil {
+		c.mu.Unlock()
+		return errors.New("server not running")
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	err = c.write(&rpcMessage{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage(strconv.FormatInt(id, 10)),
+		Method:  method,
+		Params:  b,
+	})
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		c.notify("notifications/cancelled", map[string]any{"requestId": id, "reason": ctx.Err().Error()})
+		return ctx.Err()
+	case m, ok := <-ch:
+		if !ok {
+			return errors.New("server exited")
+		}
+		if m.Error != nil {
+			return m.Error
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(m.Result, out)
+	}
+}
+
+// refreshTools replaces the registered tools of this server with the
+// ones it currently lists.
+func (c *mcpClient) refreshTools() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mcpCallTimeout)
+	defer cancel()
+
+	var listed []mcpTool
+	cursor := ""
+	for {
+		var res struct {
+			Tools      []mcpTool `json:"tools"`
+			NextCursor string    `json:"nextCursor"`
+		}
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		if err := c.call(ctx, "tools/list", params, &res); err != nil {
+			return err
+		}
+		listed = append(listed, res.Tools...)
+		if res.NextCursor == "" {
+			break
+		}
+		cursor = res.NextCursor
+	}
+
+	prefix := c.name + "__"
+	unregisterTools(prefix)
+	for _, mt := range listed {
+		schema := mt.InputSchema
+		if len(schema) == 0 {
+			schema = json.RawMessage(`{"type":"object"}`)
+		}
+		err := registerTool(&Tool{
+			Name:        mcpToolName(prefix, mt.Name),
+			Description: mt.Description,
+			Schema:      schema,
+			Func:        c.toolFunc(mt.Name),
+			Channels:    c.cfg.Channels,
+		})
+		if err != nil {
+			slog.Warn("mcp: skipping tool", "server", c.name, "err", err)
+		}
+	}
+	slog.Info("mcp: listed tools", "server", c.name, "tools", len(listed))
+	return nil
+}
+
+// mcpToolName maps an MCP tool name onto the characters and length
+// that model providers accept.
+func mcpToolName(prefix, name string) string {
+	b := []byte(prefix + name)
+	for i, ch := range b {
+		if !validToolName(string(ch)) {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 64 {
+		b = b[:64]
+	}
+	return string(b)
+}
+
+func (c *mcpClient) toolFunc(name string) ToolFunc {
+	return func(ctx context.Context, args json.RawMessage) (string, error) {
+		if err := c.ensure(); err != nil {
+			return "", fmt.Errorf("mcp %s: restart: %v", c.name, err)
+		}
+
+		var res mcpCallResult
+		err := c.call(ctx, "tools/call", map[string]any{
+			"name":      name,
+			"arguments": args,
+		}, &res)
+		if err != nil {
+			return "", err
+		}
+
+		var sb strings.Builder
+		for i, item := range res.Content {
+			if i > 0 {
+				sb.WriteByte('\n')
+			}
+			if item.Type == "text" {
+				sb.WriteString(item.Text)
+			} else {
+				fmt.Fprintf(&sb, "[%s %s]", item.Type, item.MimeType)
+			}
+		}
+		if res.IsError {
+			return "", errors.New(sb.String())
+		}
+		return sb.String(), nil
+	}
+}
+
+// Close shuts the server down by closing its stdin.
+func (c *mcpClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stdin.Close()
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// mcpSession is the caller of burp's own MCP tools.
+type mcpSession struct {
+	srv    *Server
+	ident  Identity
+	authed bool   // whether ident was authenticated; false means full access
+	client string // rate limiting key
+}
+
+func (ss *mcpSession) allowed(id string, need ChannelRole) bool {
+	if !ss.authed {
+		return true
+	}
+	if ss.ident.Channel != "" && ss.ident.Channel != id {
+		return false
+	}
+	return channelRole(id, ss.ident.Name) >= need
+}
+
+const channelSchema = `"channel":{"type":"string","description":"alphanumeric channel ID, at most 32 characters"}`
+
+var mcpServerTools = []mcpTool{
+	{
+		Name:        "post_message",
+		Description: "Posts a message to a burp channel without asking the model to reply.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{` + channelSchema + `,"text":{"type":"string"}},"required":["channel","text"]}`),
+	},
+	{
+		Name:        "read_recent",
+		Description: "Returns recent messages of a burp channel as a JSON array, newest first.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{` + channelSchema + `,"after":{"type":"string","description":"only return messages after this RFC3339Nano time"}},"required":["channel"]}`),
+	},
+	{
+		Name:        "wait_for_message",
+		Description: "Waits up to 30 seconds for the next message in a burp channel and returns it as JSON. Pass the Time of the last message seen as after; on timeout the result has LongPollTimeout set.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{` + channelSchema + `,"after":{"type":"string","description":"RFC3339Nano time; defaults to now"}},"required":["channel"]}`),
+	},
+	{
+		Name:        "ask_model",
+		Description: "Posts a prompt to a burp channel, waits for the model's reply and returns it. The model sees the channel history.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{` + channelSchema + `,"prompt":{"type":"string"},"model":{"type":"string"},"temp":{"type":"number"},"max_tokens":{"type":"integer"},"tools":{"type":"string","description":"comma-separated tool names, or * for all"},"persona":{"type":"string","description":"name of a configured persona"}},"required":["channel","prompt","model"]}`),
+	},
+}
+
+// handle answers one JSON-RPC message. It returns nil for
+// notifications and responses.
+func (ss *mcpSession) handle(ctx context.Context, m *rpcMessage) *rpcMessage {
+	if m.Method == "" || m.ID == nil {
+		return nil
+	}
+
+	resp := &rpcMessage{JSONRPC: "2.0", ID: m.ID}
+	result, err := ss.dispatch(ctx, m.Method, m.Params)
+	if err != nil {
+		var re *rpcError
+		if !errors.As(err, &re) {
+			re = &rpcError{Code: rpcInternalError, Message: err.Error()}
+		}
+		resp.Error = re
+		return resp
+	}
+	if resp.Result, err = json.Marshal(result); err != nil {
+		resp.Error = &rpcError{Code: rpcInternalError, Message: err.Error()}
+	}
+	return resp
+}
+
+func (ss *mcpSession) dispatch(ctx context.Context, method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "initialize":
+		return map[string]any{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "burp", "version": "1"},
+		}, nil
+	case "ping":
+		return struct{}{}, nil
+	case "tools/list":
+		return map[string]any{"tools": mcpServerTools}, nil
+	case "tools/call":
+		var p struct {
+			Name      string
+			Arguments json.RawMessage
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+		if len(p.Arguments) == 0 {
+			p.Arguments = json.RawMessage("{}")
+		}
+		text, err := ss.callTool(ctx, p.Name, p.Arguments)
+		if err != nil {
+			var re *rpcError
+			if errors.As(err, &re) {
+				return nil, err
+			}
+			return mcpCallResult{Content: []mcpContent{{Type: "text", Text: err.Error()}}, IsError: true}, nil
+		}
+		return mcpCallResult{Content: []mcpContent{{Type: "text", Text: text}}}, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + method}
+}
+
+type mcpToolArgs struct {
+	Channel   string
+	Text      string
+	After     string
+	Prompt    string
+	Model     string
+	Temp      *float64
+	MaxTokens *int64 `json:"max_tokens"`
+	Tools     string
+	Persona   string
+}
+
+func (ss *mcpSession) callTool(ctx context.Context, name string, raw json.RawMessage) (string, error) {
+	var args mcpToolArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+
+	id := args.Channel
+	if id == "" || len(id) > 32 || !isNonEmptyAlnum(id) {
+		return "", errors.New("channel must be alphanumeric and <= 32 characters")
+	}
+
+	var after time.Time
+	if args.After != "" {
+		var err error
+		if after, err = time.Parse(time.RFC3339Nano, args.After); err != nil {
+			return "", errors.New("after must be RFC3339Nano")
+		}
+	}
+
+	switch name {
+	case "post_message":
+		return ss.postMessage(id, args.Text)
+	case "read_recent":
+		return ss.readRecent(id, after)
+	case "wait_for_message":
+		return ss.waitForMessage(ctx, id, after)
+	case "ask_model":
+		return ss.askModel(ctx, id, args)
+	}
+	return "", &rpcError{Code: rpcInvalidParams, Message: "unknown tool: " + name}
+}
+
+func (ss *mcpSession) postMessage(id, text string) (string, error) {
+	if !ss.allowed(id, RoleWrite) {
+		return "", errors.New("forbidden")
+	}
+	if text == "" {
+		return "", errors.New("text cannot be blank")
+	}
+	tier, maxChars := postLimits("")
+	if int64(len(text)) > maxChars {
+		return "", errors.New("text too long")
+	}
+	if retryAfter, reason := ss.srv.lim.AllowRequest(ss.client, tier); reason != "" {
+		return "", fmt.Errorf("%s; retry in %s", reason, retryAfter.Round(time.Second))
+	}
+	msg := &Message{ID: id, Body: text, Author: ss.ident.Name, Role: UserMessage}
+	publish(msg)
+	return "posted at " + msg.Time.Time().Format(time.RFC3339Nano), nil
+}
+
+func (ss *mcpSession) readRecent(id string, after time.Time) (string, error) {
+	if !ss.allowed(id, RoleRead) {
+		return "", errors.New("forbidden")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var buf bytes.Buffer
+	buf.WriteString("[\n")
+	n := 0
+	for i := len(recent[id]) - 1; i >= 0; i-- {
+		msg := recent[id][i]
+		if msg.Time.Time().Before(after) {
+			continue
+		}
+		if n > 0 {
+			buf.WriteString(",\n")
+		}
+		buf.WriteString(msg.json)
+		n++
+	}
+	buf.WriteString("\n]")
+	return buf.String(), nil
+}
+
+func (ss *mcpSession) waitForMessage(ctx context.Context, id string, after time.Time) (string, error) {
+	if !ss.allowed(id, RoleRead) {
+		return "", errors.New("forbidden")
+	}
+	if after.IsZero() {
+		after = time.Now()
+	}
+
+	ch := make(chan *messageAndJSON, 1)
+	register(id, ch, after)
+	defer unregister(id, ch)
+
+	timer := time.NewTimer(30 * time.Second)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-timer.C:
+		return newMessageAndJSON(&Message{LongPollTimeout: true}).json, nil
+	case msg := <-ch:
+		return msg.json, nil
+	}
+}
+
+func (ss *mcpSession) askModel(ctx context.Context, id string, args mcpToolArgs) (string, error) {
+	if !ss.allowed(id, RoleWrite) {
+		return "", errors.New("forbidden")
+	}
+	if args.Prompt == "" {
+		return "", errors.New("prompt cannot be blank")
+	}
+
+	// Reuse the HTTP validation of model parameters.
+	q := url.Values{"id": {id}, "model": {args.Model}}
+	if args.Temp != nil {
+		q.Set("temp", strconv.FormatFloat(*args.Temp, 'g', -1, 64))
+	}
+	if args.MaxTokens != nil {
+		q.Set("max_tokens", strconv.FormatInt(*args.MaxTokens, 10))
+	}
+	if args.Tools != "" {
+		q.Set("tools", args.Tools)
+	}
+	if args.Persona != "" {
+		q.Set("persona", args.Persona)
+	}
+	r, _ := http.NewRequest(http.MethodGet, "/?"+q.Encode(), nil)
+	_, model, _, params, reason := ss.srv.parseRequest(r)
+	if reason != "" {
+		return "", errors.New(reason)
+	}
+	if int64(len(args.Prompt)) > modelMaxInputChars[model] {
+		return "", errors.New("prompt too long")
+	}
+
+	tier := modelTier[model]
+	if retryAfter, reason := ss.srv.lim.Allow(ss.client, tier); reason != "" {
+		return "", fmt.Errorf("%s; retry in %s", reason, retryAfter.Round(time.Second))
+	}
+	if ss.srv.wkr.Draining() {
+		return "", errors.New("server shutting down")
+	}
+	if retryAfter, ok := ss.srv.wkr.Available(model); !ok {
+		return "", fmt.Errorf("model unavailable; retry in %s", retryAfter.Round(time.Second))
+	}
+
+	publishContext(ctx, &Message{ID: id, Body: args.Prompt, Author: ss.ident.Name, Role: UserMessage})
+
+	usage, reply, err := ss.srv.wkr.Send(ctx, id, args.Prompt, model, params)
+	if err != nil {
+		return "", err
+	}
+	ss.srv.lim.Charge(ss.client, modelTier[usage.Model], usage.OutputTokens)
+	return reply, nil
+}
+
+// serveMCP implements the MCP streamable HTTP transport without server
+// initiated streams: each POSTed request is answered with a single JSON
+// response.
+func (s *Server) serveMCP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ss := &mcpSession{srv: s, client: clientKey(r)}
+	ss.ident, ss.authed = identityFrom(r.Context())
+
+	var m rpcMessage
+	var resp *rpcMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		resp = &rpcMessage{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}}
+	} else if resp = ss.handle(r.Context(), &m); resp == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ServeMCPStdio serves MCP over newline-delimited JSON-RPC on r and w
+// until r is exhausted. Callers on stdio are trusted with every channel.
+func (s *Server) ServeMCPStdio(r io.Reader, w io.Writer) error {
+	ss := &mcpSession{srv: s, client: "mcp:stdio"}
+
+	var (
+		wmu     sync.Mutex
+		cmu     sync.Mutex
+		cancels = map[string]context.CancelFunc{} // request ID -> cancel
+	)
+	write := func(m *rpcMessage) {
+		b, _ := json.Marshal(m)
+		wmu.Lock()
+		defer wmu.Unlock()
+		w.Write(append(b, '\n'))
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var m rpcMessage
+			if err := json.Unmarshal(line, &m); err != nil {
+				write(&rpcMessage{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			} else if m.Method == "notifications/cancelled" {
+				var p struct{ RequestID json.RawMessage }
+				json.Unmarshal(m.Params, &p)
+				cmu.Lock()
+				if cancel := cancels[string(p.RequestID)]; cancel != nil {
+					cancel()
+				}
+				cmu.Unlock()
+			} else if m.ID != nil && m.Method != "" {
+				ctx, cancel := context.WithCancel(withRequestID(context.Background(), newRequestID()))
+				key := string(m.ID)
+				cmu.Lock()
+				cancels[key] = cancel
+				cmu.Unlock()
+				go func() {
+					resp := ss.handle(ctx, &m)
+					cmu.Lock()
+					delete(cancels, key)
+					cmu.Unlock()
+					cancelled := ctx.Err() != nil
+					cancel()
+					if !cancelled {
+						write(resp)
+					}
+				}()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
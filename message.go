@@ -2,7 +2,8 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
+	"slices"
 	"sync"
 	"time"
 
@@ -15,6 +16,15 @@ const (
 	SystemMessage MessageRole = iota
 	AssistantMessage
 	UserMessage
+	// ToolCallMessage records a tool invocation by the assistant; Body
+	// holds the JSON arguments.
+	ToolCallMessage
+	// ToolResultMessage records the output of a tool invocation.
+	ToolResultMessage
+	// ThinkingMessage carries the model's thinking, or a summary of
+	// its reasoning, ahead of or alongside its reply. It is not sent
+	// back to the model.
+	ThinkingMessage
 )
 
 type Message struct {
@@ -22,6 +32,10 @@ type Message struct {
 	ID string `json:",omitempty"`
 	// Body is the input.
 	Body string
+	// Author is the nickname of the user who sent a user message.
+	Author string `json:",omitempty"`
+	// Attachments are files sent with a user message.
+	Attachments []*Attachment `json:",omitempty"`
 	// Model is the model used for assistant messages .
 	Model ChatModel `json:",omitempty"`
 	// Time is the time the message was received, or the time of the
@@ -31,8 +45,22 @@ type Message struct {
 	// LongPollTimeout indicates that no message received and the
 	// client should retry with ?after=<Time>.
 	LongPollTimeout bool `json:",omitempty"`
+	// Shutdown indicates that the server is shutting down. The client
+	// should retry after a delay, with the previous ?after.
+	Shutdown bool `json:",omitempty"`
 	// Role of the message sent.
 	Role MessageRole `json:",omitempty"`
+	// Tool is the name of the tool for tool call and result messages.
+	Tool string `json:",omitempty"`
+	// CallID pairs a tool result with its call.
+	CallID string `json:",omitempty"`
+	// ToolError indicates that the tool call failed.
+	ToolError bool `json:",omitempty"`
+	// SchemaValid is set on the terminator of a reply generated with a
+	// response format, reporting whether the reply matched the schema.
+	SchemaValid *bool `json:",omitempty"`
+	// SchemaError explains why the reply did not match.
+	SchemaError string `json:",omitempty"`
 }
 
 type messageAndJSON struct {
@@ -41,34 +69,40 @@ type messageAndJSON struct {
 }
 
 var (
-	mu      sync.Mutex                                       // guards following
-	recent  = map[string][]*messageAndJSON{}                 // newest at end
-	waiting = map[string]map[chan *messageAndJSON]struct{}{} // long-poll chans
+	mu       sync.Mutex                                        // guards following
+	recent   = map[string][]*messageAndJSON{}                  // newest at end
+	waiting  = map[string]map[chan *messageAndJSON]time.Time{} // long-poll chans, when they started
+	shutdown *messageAndJSON                                   // answers long polls once set
+	used     = map[string]time.Time{}                          // last publish or read of channels in recent
+	stored   int                                               // JSON bytes of the messages in recent
 )
 
 func newMessageAndJSON(msg *Message) *messageAndJSON {
 	msg.Time = types.Time3339(time.Now())
+	return marshalMessage(msg)
+}
+
+func marshalMessage(msg *Message) *messageAndJSON {
 	j, err := json.MarshalIndent(msg, "", "\t")
 	if err != nil {
-		log.Printf("JSON marshal error: %v", err)
+		slog.Error("cannot marshal message", "err", err)
 	}
 	return &messageAndJSON{Message: msg, json: string(j)}
 }
 
-const keepMin = 50
-
 // trimRecentLocked trims the per-ID ring buffer in-place.
 //
 // Must be called with mu held.
 func trimRecentLocked(id string) {
-	const maxAge = 1 * time.Hour
+	retention := config().Retention
+	keepMin := retention.KeepMin
 
 	list := recent[id]
 	if len(list) <= keepMin {
 		return
 	}
 
-	cutoff := time.Now().Add(-maxAge)
+	cutoff := time.Now().Add(-time.Duration(retention.MaxAge))
 
 	trim := 0
 	for trim < len(list) &&
@@ -80,15 +114,41 @@ func trimRecentLocked(id string) {
 		return // nothing to do
 	}
 
+	stored -= listBytes(list[:trim])
+
 	// shift the tail left, keep the same backing array
 	copy(list, list[trim:])
+	clear(list[len(list)-trim:]) // let the trimmed messages be collected
 	recent[id] = list[:len(list)-trim]
 }
 
+func listBytes(list []*messageAndJSON) int {
+	n := 0
+	for _, mj := range list {
+		n += len(mj.json)
+	}
+	return n
+}
+
+// touchLocked marks channel id as used, if it holds messages.
+//
+// Must be called with mu held.
+func touchLocked(id string) {
+	if _, ok := recent[id]; ok {
+		used[id] = time.Now()
+	}
+}
+
 func register(id string, ch chan *messageAndJSON, after time.Time) {
 	mu.Lock()
 	defer mu.Unlock()
 
+	if shutdown != nil {
+		ch <- shutdown
+		return
+	}
+	touchLocked(id)
+
 	for _, msg := range recent[id] {
 		if msg.Time.Time().After(after) {
 			ch <- msg
@@ -97,9 +157,9 @@ func register(id string, ch chan *messageAndJSON, after time.Time) {
 	}
 
 	if waiting[id] == nil {
-		waiting[id] = make(map[chan *messageAndJSON]struct{})
+		waiting[id] = make(map[chan *messageAndJSON]time.Time)
 	}
-	waiting[id][ch] = struct{}{}
+	waiting[id][ch] = time.Now()
 }
 
 func unregister(id string, ch chan *messageAndJSON) {
@@ -111,25 +171,86 @@ func unregister(id string, ch chan *messageAndJSON) {
 	}
 }
 
+// truncate drops all but the last keep messages of channel id and
+// returns how many it dropped.
+func truncate(id string, keep int) int {
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := recent[id]
+	n := max(len(list)-keep, 0)
+	stored -= listBytes(list[:n])
+	if n == len(list) {
+		delete(recent, id)
+		delete(used, id)
+	} else {
+		recent[id] = slices.Delete(list, 0, n)
+	}
+	return n
+}
+
+// closeWaiters answers every pending long poll, and those that follow,
+// with a Shutdown message.
+func closeWaiters() {
+	msg := newMessageAndJSON(&Message{Shutdown: true})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	shutdown = msg
+	for id, chans := range waiting {
+		for ch := range chans {
+			ch <- msg
+		}
+		delete(waiting, id)
+	}
+}
+
+// publish stores msg, answers the long polls waiting for it and sends
+// it over the bus to the other instances.
 func publish(msg *Message) {
 	if msg.ID == "" {
-		log.Printf("message dropped: missing channel ID")
+		slog.Warn("message dropped: missing channel ID")
 		return
 	}
 
 	mj := newMessageAndJSON(msg)
+	deliver(mj)
+	bus.Publish(msg)
+}
+
+// receive stores a message published by another instance and answers
+// the long polls waiting for it.
+func receive(msg *Message) {
+	if msg.ID == "" || msg.LongPollTimeout || msg.Shutdown {
+		return
+	}
+	deliver(marshalMessage(msg))
+}
+
+func deliver(mj *messageAndJSON) {
+	id := mj.ID
 
 	mu.Lock()
 	defer mu.Unlock()
 
-	recent[msg.ID] = append(recent[msg.ID], mj)
-	trimRecentLocked(msg.ID)
+	// Messages from other instances may arrive late; keep the list in
+	// time order, which register relies on.
+	list := append(recent[id], mj)
+	for i := len(list) - 1; i > 0 && list[i-1].Time.Time().After(mj.Time.Time()); i-- {
+		list[i-1], list[i] = list[i], list[i-1]
+	}
+	recent[id] = list
+	used[id] = time.Now()
+	stored += len(mj.json)
+	trimRecentLocked(id)
+	evictLocked(id)
 
-	for ch := range waiting[msg.ID] {
+	for ch := range waiting[id] {
 		ch <- mj
-		delete(waiting[msg.ID], ch)
+		delete(waiting[id], ch)
 	}
-	if len(waiting[msg.ID]) == 0 {
-		delete(waiting, msg.ID)
+	if len(waiting[id]) == 0 {
+		delete(waiting, id)
 	}
 }
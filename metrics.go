@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	anthropic "github.com/anthropics/anthropic-sdk-go"
+	"github.com/openai/openai-go/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Metrics are exported at /metrics in the Prometheus text format.
+var (
+	httpRequests = newCounterVec("burp_http_requests_total",
+		"HTTP requests by handler and status code.", "handler", "code")
+	httpDuration = newHistogramVec("burp_http_request_duration_seconds",
+		"HTTP request latency by handler; /wait includes the long poll.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}, "handler")
+
+	generationsInFlight atomic.Int64
+	timeToFirstToken    = newHistogramVec("burp_time_to_first_token_seconds",
+		"Time from the start of a generation to its first output, including retries.",
+		[]float64{.1, .25, .5, 1, 2, 4, 8, 16, 32}, "model")
+	tokensPerSecond = newHistogramVec("burp_tokens_per_second",
+		"Output tokens per second after the first token, per generation.",
+		[]float64{5, 10, 20, 40, 80, 160, 320}, "model")
+	tokens = newCounterVec("burp_tokens_total",
+		"Tokens processed by model and direction (input or output).", "model", "direction")
+	providerErrors = newCounterVec("burp_provider_errors_total",
+		"Failed provider requests by provider, model and status code.", "provider", "model", "code")
+	channelEvictions = newCounterVec("burp_channel_evictions_total",
+		"Channels whose messages were dropped from memory, by reason (idle, channels or bytes).", "reason")
+	evictedBytes = newCounterVec("burp_evicted_bytes_total",
+		"Size of the messages dropped with evicted channels, as JSON, by reason.", "reason")
+	busMessages = newCounterVec("burp_bus_messages_total",
+		"Messages sent to and received from other instances over the bus.", "direction")
+	busDropped = newCounterVec("burp_bus_dropped_total",
+		"Messages not sent over the bus, by reason.", "reason")
+)
+
+// metricVec is a counter or histogram with labels.
+type metricVec struct {
+	name, help, typ string
+	labels          []string
+	buckets         []float64 // histograms only
+
+	mu     sync.Mutex
+	series map[string]*series // by label values joined with \xff
+}
+
+type series struct {
+	values []string
+	value  float64  // counter value, or histogram sum
+	count  uint64   // histogram observations
+	counts []uint64 // per bucket, not cumulative
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, typ: "counter", labels: labels, series: make(map[string]*series)}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, typ: "histogram", labels: labels, buckets: buckets, series: make(map[string]*series)}
+}
+
+func (v *metricVec) seriesLocked(values []string) *series {
+	k := strings.Join(values, "\xff")
+	s := v.series[k]
+	if s == nil {
+		s = &series{values: slices.Clone(values)}
+		if v.buckets != nil {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[k] = s
+	}
+	return s
+}
+
+// Add adds delta to a counter.
+func (v *metricVec) Add(delta float64, values ...string) {
+	v.mu.Lock()
+	v.seriesLocked(values).value += delta
+	v.mu.Unlock()
+}
+
+// Observe records x in a histogram.
+func (v *metricVec) Observe(x float64, values ...string) {
+	v.mu.Lock()
+	s := v.seriesLocked(values)
+	s.value += x
+	s.count++
+	if i, _ := slices.BinarySearch(v.buckets, x); i < len(v.buckets) {
+		s.counts[i]++
+	}
+	v.mu.Unlock()
+}
+
+func (v *metricVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		labels := formatLabels(v.labels, s.values)
+		if v.typ == "counter" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, labels, formatFloat(s.value))
+			continue
+		}
+		names := append(slices.Clip(v.labels), "le")
+		values := append(slices.Clip(s.values), "")
+		var cum uint64
+		for i, b := range v.buckets {
+			cum += s.counts[i]
+			values[len(values)-1] = formatFloat(b)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(names, values), cum)
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labels, formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labels, s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		labelEscaper.WriteString(&sb, values[i])
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// observeGeneration records the timing and token counts of a finished
+// generation that started at start.
+func observeGeneration(start time.Time, usage Usage) {
+	model := string(usage.Model)
+	tokens.Add(float64(usage.InputTokens), model, "input")
+	tokens.Add(float64(usage.OutputTokens), model, "output")
+	if usage.FirstToken.IsZero() {
+		return
+	}
+	timeToFirstToken.Observe(usage.FirstToken.Sub(start).Seconds(), model)
+	if d := time.Since(usage.FirstToken).Seconds(); d > 0 && usage.OutputTokens > 0 {
+		tokensPerSecond.Observe(float64(usage.OutputTokens)/d, model)
+	}
+}
+
+// observeProviderError counts a failed provider request.
+func observeProviderError(model ChatModel, err error) {
+	code := "error"
+	var oe *openai.Error
+	var ae *anthropic.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return
+	case errors.As(err, &oe):
+		code = strconv.Itoa(oe.StatusCode)
+	case errors.As(err, &ae):
+		code = strconv.Itoa(ae.StatusCode)
+	case strings.Contains(err.Error(), "received error while streaming"):
+		code = "stream"
+	}
+	providerErrors.Add(1, providerNames[providerFor[model]], string(model), code)
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument counts, times and traces requests to h under the name
+// handler.
+func instrument(handler string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+handler, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", handler),
+			attribute.String("url.path", r.URL.Path),
+		))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r.WithContext(ctx))
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.code))
+		if rec.code >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.code))
+		}
+		httpRequests.Add(1, handler, strconv.Itoa(rec.code))
+		httpDuration.Observe(time.Since(start).Seconds(), handler)
+	}
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	mu.Lock()
+	var waiters, messages, bytes int
+	for _, chans := range waiting {
+		waiters += len(chans)
+	}
+	for _, list := range recent {
+		messages += len(list)
+		for _, mj := range list {
+			bytes += len(mj.json)
+		}
+	}
+	channels := len(recent)
+	mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	writeGauge(bw, "burp_waiters", "Long-poll requests waiting for a message.", float64(waiters))
+	writeGauge(bw, "burp_channels", "Channels with recent messages.", float64(channels))
+	writeGauge(bw, "burp_messages", "Recent messages held in memory.", float64(messages))
+	writeGauge(bw, "burp_message_bytes", "Size of the recent messages held in memory, as JSON.", float64(bytes))
+	writeGauge(bw, "burp_generations_in_flight", "Replies being generated.", float64(generationsInFlight.Load()))
+	for _, v := range []*metricVec{httpRequests, httpDuration, timeToFirstToken, tokensPerSecond, tokens, providerErrors, channelEvictions, evictedBytes, busMessages, busDropped} {
+		v.write(bw)
+	}
+	bw.Flush()
+}
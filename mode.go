@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ChannelMode controls when the assistant replies in a channel.
+type ChannelMode uint8
+
+const (
+	// ModeAlways replies to every message posted to /ask.
+	ModeAlways ChannelMode = iota
+	// ModeMention only replies to messages that mention the assistant,
+	// so that humans can chat among themselves.
+	ModeMention
+)
+
+var modeNames = map[ChannelMode]string{
+	ModeAlways:  "always",
+	ModeMention: "mention",
+}
+
+func (m ChannelMode) String() string { return modeNames[m] }
+
+func (m ChannelMode) MarshalText() ([]byte, error) { return []byte(m.String()), nil }
+
+func (m *ChannelMode) UnmarshalText(b []byte) error {
+	for mode, name := range modeNames {
+		if name == string(b) {
+			*m = mode
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown mode %q", b)
+}
+
+var (
+	modeMu sync.Mutex                 // guards following
+	modes  = map[string]ChannelMode{} // channel ID -> mode; absent means ModeAlways
+)
+
+func channelMode(id string) ChannelMode {
+	modeMu.Lock()
+	defer modeMu.Unlock()
+	return modes[id]
+}
+
+// setChannelMode sets the mode of channel id. It reports false if the
+// channel had the default mode and max_channels channels already have
+// another one.
+func setChannelMode(id string, m ChannelMode) bool {
+	modeMu.Lock()
+	defer modeMu.Unlock()
+	if m == ModeAlways {
+		delete(modes, id)
+		return true
+	}
+	if _, ok := modes[id]; !ok {
+		if max := config().Retention.MaxChannels; max > 0 && len(modes) >= max {
+			return false
+		}
+	}
+	modes[id] = m
+	return true
+}
+
+// mentionsAssistant reports whether body addresses the assistant,
+// either IRC style with a leading "burp:" or "burp," or with "@burp"
+// anywhere in the text.
+func mentionsAssistant(body string) bool {
+	s := strings.ToLower(strings.TrimSpace(body))
+	if rest, ok := strings.CutPrefix(s, AssistantName); ok &&
+		(strings.HasPrefix(rest, ":") || strings.HasPrefix(rest, ",")) {
+		return true
+	}
+	for {
+		i := strings.Index(s, "@"+AssistantName)
+		if i < 0 {
+			return false
+		}
+		s = s[i+1+len(AssistantName):]
+		if s == "" || !isNonEmptyAlnum(s[:1]) {
+			return true
+		}
+	}
+}
+
+// shouldReply reports whether a user message posted to channel id
+// should trigger a generation.
+func shouldReply(id, body string) bool {
+	return channelMode(id) != ModeMention || mentionsAssistant(body)
+}
+
+// serveMode shows (GET) or sets (POST) the reply mode of a channel with
+// mode=always|mention. Only the owner can change private channels.
+func (s *Server) serveMode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, reason := parseID(r)
+	if reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		if !s.authorize(w, r, id, RoleRead) {
+			return
+		}
+	} else {
+		need := RoleWrite
+		if isPrivate(id) {
+			need = RoleOwner
+		}
+		if !s.authorize(w, r, id, need) {
+			return
+		}
+		var m ChannelMode
+		switch r.FormValue("mode") {
+		case "always":
+			m = ModeAlways
+		case "mention":
+			m = ModeMention
+		default:
+			http.Error(w, "mode must be one of always, mention", http.StatusBadRequest)
+			return
+		}
+		if !setChannelMode(id, m) {
+			http.Error(w, "too many channels with a mode", http.StatusServiceUnavailable)
+			return
+		}
+		shareChannelState(id)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(channelMode(id).String() + "\n"))
+}
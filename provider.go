@@ -385,3 +385,234 @@ var modelMaxInputChars = map[ChatModel]int64{
 	ChatModelOpenAIGPT3_5Turbo0125:    12_250,
 	ChatModelOpenAIGPT3_5Turbo16k0613: 44_500,
 }
+
+// ModelTier groups models of similar cost for rate limiting.
+type ModelTier uint8
+
+const (
+	ModelTierSmall ModelTier = iota + 1
+	ModelTierStandard
+	ModelTierLarge
+)
+
+var modelTier = map[ChatModel]ModelTier{
+	// Claude Haiku
+	ChatModelClaude3_5HaikuLatest:    ModelTierSmall,
+	ChatModelClaude3_5Haiku20241022:  ModelTierSmall,
+	ChatModelClaude_3_Haiku_20240307: ModelTierSmall,
+
+	// Claude Sonnet
+	ChatModelClaude3_7SonnetLatest:      ModelTierStandard,
+	ChatModelClaude3_7Sonnet20250219:    ModelTierStandard,
+	ChatModelClaudeSonnet4_20250514:     ModelTierStandard,
+	ChatModelClaudeSonnet4_0:            ModelTierStandard,
+	ChatModelClaude4Sonnet20250514:      ModelTierStandard,
+	ChatModelClaude3_5SonnetLatest:      ModelTierStandard,
+	ChatModelClaude3_5Sonnet20241022:    ModelTierStandard,
+	ChatModelClaude_3_5_Sonnet_20240620: ModelTierStandard,
+
+	// Claude Opus
+	ChatModelClaudeOpus4_0:          ModelTierLarge,
+	ChatModelClaudeOpus4_20250514:   ModelTierLarge,
+	ChatModelClaude4Opus20250514:    ModelTierLarge,
+	ChatModelClaudeOpus4_1_20250805: ModelTierLarge,
+	ChatModelClaude3OpusLatest:      ModelTierLarge,
+	ChatModelClaude_3_Opus_20240229: ModelTierLarge,
+
+	// GPT-5 family
+	ChatModelOpenAIGPT5:               ModelTierStandard,
+	ChatModelOpenAIGPT5Mini:           ModelTierSmall,
+	ChatModelOpenAIGPT5Nano:           ModelTierSmall,
+	ChatModelOpenAIGPT5_2025_08_07:    ModelTierStandard,
+	ChatModelOpenAIGPT5Mini2025_08_07: ModelTierSmall,
+	ChatModelOpenAIGPT5Nano2025_08_07: ModelTierSmall,
+	ChatModelOpenAIGPT5ChatLatest:     ModelTierStandard,
+
+	// GPT-4.1 family
+	ChatModelOpenAIGPT4_1:               ModelTierStandard,
+	ChatModelOpenAIGPT4_1Mini:           ModelTierSmall,
+	ChatModelOpenAIGPT4_1Nano:           ModelTierSmall,
+	ChatModelOpenAIGPT4_1_2025_04_14:    ModelTierStandard,
+	ChatModelOpenAIGPT4_1Mini2025_04_14: ModelTierSmall,
+	ChatModelOpenAIGPT4_1Nano2025_04_14: ModelTierSmall,
+
+	// O-series
+	ChatModelOpenAIO4Mini:              ModelTierSmall,
+	ChatModelOpenAIO4Mini2025_04_16:    ModelTierSmall,
+	ChatModelOpenAIO3:                  ModelTierLarge,
+	ChatModelOpenAIO3_2025_04_16:       ModelTierLarge,
+	ChatModelOpenAIO3Mini:              ModelTierSmall,
+	ChatModelOpenAIO3Mini2025_01_31:    ModelTierSmall,
+	ChatModelOpenAIO1:                  ModelTierLarge,
+	ChatModelOpenAIO1_2024_12_17:       ModelTierLarge,
+	ChatModelOpenAIO1Preview:           ModelTierLarge,
+	ChatModelOpenAIO1Preview2024_09_12: ModelTierLarge,
+	ChatModelOpenAIO1Mini:              ModelTierSmall,
+	ChatModelOpenAIO1Mini2024_09_12:    ModelTierSmall,
+
+	// GPT-4o + Mini + Turbo
+	ChatModelOpenAIGPT4o:                            ModelTierStandard,
+	ChatModelOpenAIGPT4o2024_11_20:                  ModelTierStandard,
+	ChatModelOpenAIGPT4o2024_08_06:                  ModelTierStandard,
+	ChatModelOpenAIGPT4o2024_05_13:                  ModelTierStandard,
+	ChatModelOpenAIGPT4oAudioPreview:                ModelTierStandard,
+	ChatModelOpenAIGPT4oAudioPreview2024_10_01:      ModelTierStandard,
+	ChatModelOpenAIGPT4oAudioPreview2024_12_17:      ModelTierStandard,
+	ChatModelOpenAIGPT4oAudioPreview2025_06_03:      ModelTierStandard,
+	ChatModelOpenAIGPT4oMiniAudioPreview:            ModelTierSmall,
+	ChatModelOpenAIGPT4oMiniAudioPreview2024_12_17:  ModelTierSmall,
+	ChatModelOpenAIGPT4oSearchPreview:               ModelTierStandard,
+	ChatModelOpenAIGPT4oMiniSearchPreview:           ModelTierSmall,
+	ChatModelOpenAIGPT4oSearchPreview2025_03_11:     ModelTierStandard,
+	ChatModelOpenAIGPT4oMiniSearchPreview2025_03_11: ModelTierSmall,
+	ChatModelOpenAIChatgpt4oLatest:                  ModelTierStandard,
+	ChatModelOpenAICodexMiniLatest:                  ModelTierSmall,
+	ChatModelOpenAIGPT4oMini:                        ModelTierSmall,
+	ChatModelOpenAIGPT4oMini2024_07_18:              ModelTierSmall,
+	ChatModelOpenAIGPT4Turbo:                        ModelTierLarge,
+	ChatModelOpenAIGPT4Turbo2024_04_09:              ModelTierLarge,
+	ChatModelOpenAIGPT4_0125Preview:                 ModelTierLarge,
+	ChatModelOpenAIGPT4TurboPreview:                 ModelTierLarge,
+	ChatModelOpenAIGPT4_1106Preview:                 ModelTierLarge,
+	ChatModelOpenAIGPT4VisionPreview:                ModelTierLarge,
+
+	// GPT-4 base
+	ChatModelOpenAIGPT4:         ModelTierLarge,
+	ChatModelOpenAIGPT4_0314:    ModelTierLarge,
+	ChatModelOpenAIGPT4_0613:    ModelTierLarge,
+	ChatModelOpenAIGPT4_32k:     ModelTierLarge,
+	ChatModelOpenAIGPT4_32k0314: ModelTierLarge,
+	ChatModelOpenAIGPT4_32k0613: ModelTierLarge,
+
+	// GPT-3.5
+	ChatModelOpenAIGPT3_5Turbo:        ModelTierSmall,
+	ChatModelOpenAIGPT3_5Turbo16k:     ModelTierSmall,
+	ChatModelOpenAIGPT3_5Turbo0301:    ModelTierSmall,
+	ChatModelOpenAIGPT3_5Turbo0613:    ModelTierSmall,
+	ChatModelOpenAIGPT3_5Turbo1106:    ModelTierSmall,
+	ChatModelOpenAIGPT3_5Turbo0125:    ModelTierSmall,
+	ChatModelOpenAIGPT3_5Turbo16k0613: ModelTierSmall,
+}
+
+// ModelCap is a set of optional features a model supports.
+type ModelCap uint16
+
+const (
+	// CapTools marks models that support function calling.
+	CapTools ModelCap = 1 << iota
+	// CapVision marks models that accept image input.
+	CapVision
+	// CapPDF marks models that accept PDF documents.
+	CapPDF
+	// CapThinking marks Claude models with extended thinking.
+	CapThinking
+	// CapReasoning marks OpenAI reasoning models, which reject sampling
+	// parameters such as temperature and top_p.
+	CapReasoning
+	// CapReasoningEffort marks reasoning models that take reasoning_effort.
+	CapReasoningEffort
+	// CapJSONSchema marks models whose output can be held to a JSON
+	// Schema, natively or by forcing a tool call.
+	CapJSONSchema
+)
+
+var modelCaps = map[ChatModel]ModelCap{
+	// Claude 3.7 Sonnet
+	ChatModelClaude3_7SonnetLatest:   CapTools | CapVision | CapPDF | CapThinking | CapJSONSchema,
+	ChatModelClaude3_7Sonnet20250219: CapTools | CapVision | CapPDF | CapThinking | CapJSONSchema,
+
+	// Claude 3.5
+	ChatModelClaude3_5HaikuLatest:       CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelClaude3_5Haiku20241022:     CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelClaude3_5SonnetLatest:      CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelClaude3_5Sonnet20241022:    CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelClaude_3_5_Sonnet_20240620: CapTools | CapVision | CapJSONSchema,
+
+	// Claude 4.0 / 4.1
+	ChatModelClaudeSonnet4_20250514: CapTools | CapVision | CapPDF | CapThinking | CapJSONSchema,
+	ChatModelClaudeSonnet4_0:        CapTools | CapVision | CapPDF | CapThinking | CapJSONSchema,
+	ChatModelClaude4Sonnet20250514:  CapTools | CapVision | CapPDF | CapThinking | CapJSONSchema,
+	ChatModelClaudeOpus4_0:          CapTools | CapVision | CapPDF | CapThinking | CapJSONSchema,
+	ChatModelClaudeOpus4_20250514:   CapTools | CapVision | CapPDF | CapThinking | CapJSONSchema,
+	ChatModelClaude4Opus20250514:    CapTools | CapVision | CapPDF | CapThinking | CapJSONSchema,
+	ChatModelClaudeOpus4_1_20250805: CapTools | CapVision | CapPDF | CapThinking | CapJSONSchema,
+
+	// Claude 3 (deprecated)
+	ChatModelClaude3OpusLatest:       CapTools | CapVision | CapJSONSchema,
+	ChatModelClaude_3_Opus_20240229:  CapTools | CapVision | CapJSONSchema,
+	ChatModelClaude_3_Haiku_20240307: CapTools | CapVision | CapJSONSchema,
+
+	// GPT-5 family
+	ChatModelOpenAIGPT5:               CapTools | CapVision | CapPDF | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIGPT5Mini:           CapTools | CapVision | CapPDF | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIGPT5Nano:           CapTools | CapVision | CapPDF | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIGPT5_2025_08_07:    CapTools | CapVision | CapPDF | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIGPT5Mini2025_08_07: CapTools | CapVision | CapPDF | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIGPT5Nano2025_08_07: CapTools | CapVision | CapPDF | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIGPT5ChatLatest:     CapVision, // no function calling
+
+	// GPT-4.1 family
+	ChatModelOpenAIGPT4_1:               CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelOpenAIGPT4_1Mini:           CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelOpenAIGPT4_1Nano:           CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelOpenAIGPT4_1_2025_04_14:    CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelOpenAIGPT4_1Mini2025_04_14: CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelOpenAIGPT4_1Nano2025_04_14: CapTools | CapVision | CapPDF | CapJSONSchema,
+
+	// O-series
+	ChatModelOpenAIO4Mini:              CapTools | CapVision | CapPDF | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIO4Mini2025_04_16:    CapTools | CapVision | CapPDF | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIO3:                  CapTools | CapVision | CapPDF | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIO3_2025_04_16:       CapTools | CapVision | CapPDF | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIO3Mini:              CapTools | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIO3Mini2025_01_31:    CapTools | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIO1:                  CapTools | CapVision | CapPDF | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIO1_2024_12_17:       CapTools | CapVision | CapPDF | CapReasoning | CapReasoningEffort | CapJSONSchema,
+	ChatModelOpenAIO1Preview:           CapReasoning,
+	ChatModelOpenAIO1Preview2024_09_12: CapReasoning,
+	ChatModelOpenAIO1Mini:              CapReasoning,
+	ChatModelOpenAIO1Mini2024_09_12:    CapReasoning,
+
+	// GPT-4o + Mini + Turbo
+	ChatModelOpenAIGPT4o:                            CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelOpenAIGPT4o2024_11_20:                  CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelOpenAIGPT4o2024_08_06:                  CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelOpenAIGPT4o2024_05_13:                  CapTools | CapVision | CapPDF,
+	ChatModelOpenAIGPT4oAudioPreview:                CapTools,
+	ChatModelOpenAIGPT4oAudioPreview2024_10_01:      CapTools,
+	ChatModelOpenAIGPT4oAudioPreview2024_12_17:      CapTools,
+	ChatModelOpenAIGPT4oAudioPreview2025_06_03:      CapTools,
+	ChatModelOpenAIGPT4oMiniAudioPreview:            CapTools,
+	ChatModelOpenAIGPT4oMiniAudioPreview2024_12_17:  CapTools,
+	ChatModelOpenAIGPT4oSearchPreview:               0,
+	ChatModelOpenAIGPT4oMiniSearchPreview:           0,
+	ChatModelOpenAIGPT4oSearchPreview2025_03_11:     0,
+	ChatModelOpenAIGPT4oMiniSearchPreview2025_03_11: 0,
+	ChatModelOpenAIChatgpt4oLatest:                  CapVision,
+	ChatModelOpenAICodexMiniLatest:                  0,
+	ChatModelOpenAIGPT4oMini:                        CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelOpenAIGPT4oMini2024_07_18:              CapTools | CapVision | CapPDF | CapJSONSchema,
+	ChatModelOpenAIGPT4Turbo:                        CapTools | CapVision,
+	ChatModelOpenAIGPT4Turbo2024_04_09:              CapTools | CapVision,
+	ChatModelOpenAIGPT4_0125Preview:                 CapTools,
+	ChatModelOpenAIGPT4TurboPreview:                 CapTools,
+	ChatModelOpenAIGPT4_1106Preview:                 CapTools,
+	ChatModelOpenAIGPT4VisionPreview:                CapVision,
+
+	// GPT-4 base
+	ChatModelOpenAIGPT4:         CapTools,
+	ChatModelOpenAIGPT4_0314:    0,
+	ChatModelOpenAIGPT4_0613:    CapTools,
+	ChatModelOpenAIGPT4_32k:     CapTools,
+	ChatModelOpenAIGPT4_32k0314: 0,
+	ChatModelOpenAIGPT4_32k0613: CapTools,
+
+	// GPT-3.5
+	ChatModelOpenAIGPT3_5Turbo:        CapTools,
+	ChatModelOpenAIGPT3_5Turbo16k:     CapTools,
+	ChatModelOpenAIGPT3_5Turbo0301:    0,
+	ChatModelOpenAIGPT3_5Turbo0613:    CapTools,
+	ChatModelOpenAIGPT3_5Turbo1106:    CapTools,
+	ChatModelOpenAIGPT3_5Turbo0125:    CapTools,
+	ChatModelOpenAIGPT3_5Turbo16k0613: CapTools,
+}
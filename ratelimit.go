@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TierLimit configures the limits applied to each client per model tier.
+// Zero fields disable the corresponding limit.
+type TierLimit struct {
+	// Rate is the number of /ask requests per second refilled into the
+	// client's token bucket.
+	Rate float64
+	// Burst is the bucket capacity.
+	Burst int
+	// TokensPerHour caps the output tokens generated for a client in
+	// an hourly window.
+	TokensPerHour int64
+}
+
+var defaultTierLimits = map[ModelTier]TierLimit{
+	ModelTierSmall:    {Rate: 1, Burst: 10, TokensPerHour: 2_000_000},
+	ModelTierStandard: {Rate: 0.5, Burst: 5, TokensPerHour: 500_000},
+	ModelTierLarge:    {Rate: 0.1, Burst: 3, TokensPerHour: 100_000},
+}
+
+var tierNames = map[string]ModelTier{
+	"small":    ModelTierSmall,
+	"standard": ModelTierStandard,
+	"large":    ModelTierLarge,
+}
+
+// LoadTierLimits reads per-tier limits from a JSON file keyed by tier
+// name ("small", "standard", "large"). Tiers missing from the file keep
+// their defaults.
+func LoadTierLimits(path string) (map[ModelTier]TierLimit, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]TierLimit
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	limits, err := parseTierLimits(m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return limits, nil
+}
+
+// parseTierLimits converts limits keyed by tier name, filling in the
+// defaults of missing tiers.
+func parseTierLimits(m map[string]TierLimit) (map[ModelTier]TierLimit, error) {
+	limits := make(map[ModelTier]TierLimit, len(defaultTierLimits))
+	for tier, lim := range defaultTierLimits {
+		limits[tier] = lim
+	}
+	for name, lim := range m {
+		tier, ok := tierNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tier %q", name)
+		}
+		if lim.Rate < 0 || lim.Burst < 0 || lim.TokensPerHour < 0 {
+			return nil, fmt.Errorf("negative limit for tier %q", name)
+		}
+		limits[tier] = lim
+	}
+	return limits, nil
+}
+
+type limitKey struct {
+	client string
+	tier   ModelTier
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type quota struct {
+	used  int64
+	reset time.Time
+}
+
+// Limiter enforces per-client request rates and output token quotas.
+type Limiter struct {
+	mu      sync.Mutex // guards following
+	limits  map[ModelTier]TierLimit
+	buckets map[limitKey]*bucket
+	quotas  map[limitKey]*quota
+	swept   time.Time
+
+	now func() time.Time // time.Now, except in tests
+}
+
+func NewLimiter(limits map[ModelTier]TierLimit) *Limiter {
+	return &Limiter{
+		limits:  limits,
+		buckets: map[limitKey]*bucket{},
+		quotas:  map[limitKey]*quota{},
+		swept:   time.Now(),
+		now:     time.Now,
+	}
+}
+
+// SetLimits replaces the limits. Buckets and quotas are kept, so
+// clients don't get a fresh allowance.
+func (l *Limiter) SetLimits(limits map[ModelTier]TierLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+}
+
+// Allow takes a request token from the client's bucket for tier, if
+// the client's hourly token quota isn't used up. If the request is
+// refused, reason is non-empty and retryAfter tells when to try again. A
+// nil Limiter allows everything.
+func (l *Limiter) Allow(client string, tier ModelTier) (retryAfter time.Duration, reason string) {
+	if l == nil {
+		return 0, ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweepLocked(now)
+	if retryAfter, reason := l.quotaLocked(client, tier, now); reason != "" {
+		return retryAfter, reason
+	}
+	return l.takeLocked(client, tier, now)
+}
+
+// AllowRequest is like Allow but ignores the quota, for requests that
+// may not generate anything.
+func (l *Limiter) AllowRequest(client string, tier ModelTier) (retryAfter time.Duration, reason string) {
+	if l == nil {
+		return 0, ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweepLocked(now)
+	return l.takeLocked(client, tier, now)
+}
+
+// CheckQuota reports whether the client's hourly token quota for tier
+// is used up, like Allow, without taking a request token.
+func (l *Limiter) CheckQuota(client string, tier ModelTier) (retryAfter time.Duration, reason string) {
+	if l == nil {
+		return 0, ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.quotaLocked(client, tier, l.now())
+}
+
+// Must be called with l.mu held.
+func (l *Limiter) quotaLocked(client string, tier ModelTier, now time.Time) (time.Duration, string) {
+	lim := l.limits[tier]
+	if lim.TokensPerHour > 0 {
+		q := l.quotas[limitKey{client, tier}]
+		if q != nil && now.Before(q.reset) && q.used >= lim.TokensPerHour {
+			return q.reset.Sub(now), "hourly token quota exceeded"
+		}
+	}
+	return 0, ""
+}
+
+// Must be called with l.mu held.
+func (l *Limiter) takeLocked(client string, tier ModelTier, now time.Time) (time.Duration, string) {
+	lim := l.limits[tier]
+	if lim.Rate <= 0 || lim.Burst <= 0 {
+		return 0, ""
+	}
+	k := limitKey{client, tier}
+	b := l.buckets[k]
+	if b == nil {
+		b = &bucket{tokens: float64(lim.Burst), last: now}
+		l.buckets[k] = b
+	}
+	b.tokens = math.Min(float64(lim.Burst), b.tokens+now.Sub(b.last).Seconds()*lim.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / lim.Rate * float64(time.Second)), "rate limit exceeded"
+	}
+	b.tokens--
+	return 0, ""
+}
+
+// Charge adds generated output tokens to the client's hourly quota.
+func (l *Limiter) Charge(client string, tier ModelTier, tokens int64) {
+	if l == nil || tokens <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits[tier].TokensPerHour <= 0 {
+		return
+	}
+
+	now := l.now()
+	k := limitKey{client, tier}
+	q := l.quotas[k]
+	if q == nil || !now.Before(q.reset) {
+		q = &quota{reset: now.Add(time.Hour)}
+		l.quotas[k] = q
+	}
+	q.used += tokens
+}
+
+// sweepLocked drops full buckets and expired quotas every few minutes.
+//
+// Must be called with l.mu held.
+func (l *Limiter) sweepLocked(now time.Time) {
+	const every = 10 * time.Minute
+
+	if now.Sub(l.swept) < every {
+		return
+	}
+	l.swept = now
+
+	for k, b := range l.buckets {
+		lim := l.limits[k.tier]
+		if b.tokens+now.Sub(b.last).Seconds()*lim.Rate >= float64(lim.Burst) {
+			delete(l.buckets, k)
+		}
+	}
+	for k, q := range l.quotas {
+		if !now.Before(q.reset) {
+			delete(l.quotas, k)
+		}
+	}
+}
+
+// postLimits returns the tier whose bucket a post for model takes a
+// request token from, and the longest text it may have. Posts that are
+// not for any model use the small tier and the shortest input a model
+// accepts.
+func postLimits(model ChatModel) (ModelTier, int64) {
+	if model != "" {
+		return modelTier[model], modelMaxInputChars[model]
+	}
+	var chars int64 = math.MaxInt64
+	for _, n := range modelMaxInputChars {
+		chars = min(chars, n)
+	}
+	return ModelTierSmall, chars
+}
+
+// clientKey identifies the client for rate limiting: the authenticated
+// identity if there is one, the remote IP otherwise.
+func clientKey(r *http.Request) string {
+	if ident, ok := identityFrom(r.Context()); ok {
+		return "id:" + ident.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// tooManyRequests replies 429 with a Retry-After header.
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, reason string) {
+	retryAfterError(w, http.StatusTooManyRequests, retryAfter, reason)
+}
+
+// retryAfterError replies with the error code and a Retry-After header
+// rounded up to whole seconds.
+func retryAfterError(w http.ResponseWriter, code int, retryAfter time.Duration, reason string) {
+	secs := int64(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	http.Error(w, reason, code)
+}
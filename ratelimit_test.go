@@ -0,0 +1,168 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testLimiter returns a Limiter with the given limits whose clock only
+// moves when the returned function is called.
+func testLimiter(limits map[ModelTier]TierLimit) (*Limiter, func(time.Duration)) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLimiter(limits)
+	l.now = func() time.Time { return now }
+	l.swept = now
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLimiterBucket(t *testing.T) {
+	l, advance := testLimiter(map[ModelTier]TierLimit{
+		ModelTierSmall: {Rate: 2, Burst: 3},
+	})
+	allow := func(client string, tier ModelTier, want time.Duration) {
+		t.Helper()
+		retryAfter, reason := l.AllowRequest(client, tier)
+		if (reason == "") != (want == 0) || retryAfter != want {
+			t.Fatalf("AllowRequest(%q, %v) = %v, %q; want retry after %v", client, tier, retryAfter, reason, want)
+		}
+	}
+
+	// A new client starts with a full bucket.
+	for range 3 {
+		allow("a", ModelTierSmall, 0)
+	}
+	allow("a", ModelTierSmall, 500*time.Millisecond)
+
+	// Other clients and tiers have their own buckets; tiers without
+	// limits allow everything.
+	allow("b", ModelTierSmall, 0)
+	for range 10 {
+		allow("a", ModelTierLarge, 0)
+	}
+
+	// Tokens refill at Rate per second.
+	advance(250 * time.Millisecond)
+	allow("a", ModelTierSmall, 250*time.Millisecond)
+	advance(250 * time.Millisecond)
+	allow("a", ModelTierSmall, 0)
+	allow("a", ModelTierSmall, 500*time.Millisecond)
+
+	// ... up to Burst.
+	advance(time.Hour)
+	for range 3 {
+		allow("a", ModelTierSmall, 0)
+	}
+	allow("a", ModelTierSmall, 500*time.Millisecond)
+}
+
+func TestLimiterQuota(t *testing.T) {
+	l, advance := testLimiter(map[ModelTier]TierLimit{
+		ModelTierSmall:    {TokensPerHour: 100},
+		ModelTierStandard: {Rate: 1, Burst: 1, TokensPerHour: 100},
+	})
+
+	if _, reason := l.CheckQuota("a", ModelTierSmall); reason != "" {
+		t.Fatalf("fresh quota refused: %s", reason)
+	}
+	l.Charge("a", ModelTierSmall, 60)
+	advance(20 * time.Minute)
+	l.Charge("a", ModelTierSmall, 39)
+	if _, reason := l.CheckQuota("a", ModelTierSmall); reason != "" {
+		t.Fatalf("quota refused at 99 tokens: %s", reason)
+	}
+	l.Charge("a", ModelTierSmall, 1)
+
+	// The quota is used up until an hour after the first charge.
+	retryAfter, reason := l.CheckQuota("a", ModelTierSmall)
+	if reason == "" || retryAfter != 40*time.Minute {
+		t.Fatalf("CheckQuota = %v, %q; want refusal for 40m", retryAfter, reason)
+	}
+	if _, reason := l.Allow("a", ModelTierSmall); reason == "" {
+		t.Fatal("Allow ignored the quota")
+	}
+	if _, reason := l.AllowRequest("a", ModelTierSmall); reason != "" {
+		t.Fatalf("AllowRequest applied the quota: %s", reason)
+	}
+	if _, reason := l.CheckQuota("b", ModelTierSmall); reason != "" {
+		t.Fatalf("quota of another client refused: %s", reason)
+	}
+	if _, reason := l.CheckQuota("a", ModelTierStandard); reason != "" {
+		t.Fatalf("quota of another tier refused: %s", reason)
+	}
+
+	// Then a new window starts with the next charge.
+	advance(40 * time.Minute)
+	if _, reason := l.CheckQuota("a", ModelTierSmall); reason != "" {
+		t.Fatalf("quota refused after reset: %s", reason)
+	}
+	l.Charge("a", ModelTierSmall, 99)
+	if _, reason := l.CheckQuota("a", ModelTierSmall); reason != "" {
+		t.Fatalf("old charges counted after reset: %s", reason)
+	}
+
+	// A refused quota doesn't take a request token.
+	l.Charge("a", ModelTierStandard, 100)
+	if _, reason := l.Allow("a", ModelTierStandard); reason == "" {
+		t.Fatal("Allow ignored the quota")
+	}
+	if _, reason := l.AllowRequest("a", ModelTierStandard); reason != "" {
+		t.Fatalf("refused quota took a request token: %s", reason)
+	}
+
+	// Charges are ignored where there is no quota.
+	l.Charge("a", ModelTierLarge, 1_000_000)
+	if len(l.quotas) != 2 {
+		t.Fatalf("%d quotas, want 2", len(l.quotas))
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	l, advance := testLimiter(map[ModelTier]TierLimit{
+		ModelTierSmall: {Rate: 1, Burst: 1, TokensPerHour: 100},
+		ModelTierLarge: {Rate: 0.001, Burst: 1},
+	})
+	l.AllowRequest("fast", ModelTierSmall)
+	l.AllowRequest("slow", ModelTierLarge)
+	l.Charge("fast", ModelTierSmall, 10)
+
+	// Nothing is swept before 10 minutes have passed.
+	advance(9 * time.Minute)
+	l.AllowRequest("other", ModelTierLarge)
+	if len(l.buckets) != 3 || len(l.quotas) != 1 {
+		t.Fatalf("swept early: %d buckets, %d quotas", len(l.buckets), len(l.quotas))
+	}
+
+	// Then full buckets go, while the partly refilled one and the
+	// unexpired quota stay.
+	advance(time.Minute)
+	l.CheckQuota("fast", ModelTierSmall) // doesn't sweep
+	if len(l.buckets) != 3 {
+		t.Fatalf("CheckQuota swept buckets")
+	}
+	l.AllowRequest("other", ModelTierSmall)
+	if len(l.buckets) != 3 || l.buckets[limitKey{"fast", ModelTierSmall}] != nil ||
+		l.buckets[limitKey{"slow", ModelTierLarge}] == nil || len(l.quotas) != 1 {
+		t.Fatalf("after sweep: %d buckets, %d quotas", len(l.buckets), len(l.quotas))
+	}
+
+	// Expired quotas go at the next sweep after they reset.
+	advance(time.Hour)
+	l.Allow("other", ModelTierSmall)
+	if len(l.quotas) != 0 {
+		t.Fatalf("expired quota kept")
+	}
+}
+
+func TestLimiterNil(t *testing.T) {
+	var l *Limiter
+	if _, reason := l.Allow("a", ModelTierSmall); reason != "" {
+		t.Error(reason)
+	}
+	if _, reason := l.AllowRequest("a", ModelTierSmall); reason != "" {
+		t.Error(reason)
+	}
+	if _, reason := l.CheckQuota("a", ModelTierSmall); reason != "" {
+		t.Error(reason)
+	}
+	l.Charge("a", ModelTierSmall, 1)
+}
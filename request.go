@@ -1,17 +1,34 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 type messageParams struct {
 	// always set
-	MaxTokens   int64
-	Temperature float64
+	MaxTokens int64
 	// optionals
-	TopP *float64
-	TopK *int64 // Anthropic only; always nil for OpenAI
+	Temperature *float64 // nil for the provider default, and for reasoning models
+	TopP        *float64
+	TopK        *int64  // Anthropic only; always nil for OpenAI
+	Tools       []*Tool // tools the model may call
+	// ThinkingBudget enables extended thinking with this many tokens;
+	// Anthropic only, 0 disables it.
+	ThinkingBudget int64
+	// ReasoningEffort is minimal, low, medium or high; OpenAI only.
+	ReasoningEffort string
+	Stop            []string // stop sequences
+	// OpenAI only
+	Seed             *int64
+	PresencePenalty  *float64
+	FrequencyPenalty *float64
+	// ResponseFormat is a JSON Schema the reply must match.
+	ResponseFormat json.RawMessage
+	// System is the system prompt; empty for the default persona's.
+	System string
 }
 
 func (s *Server) parseRequest(r *http.Request) (id string, model ChatModel, provider ChatProvider, params messageParams, reason string) {
@@ -24,12 +41,16 @@ func (s *Server) parseRequest(r *http.Request) (id string, model ChatModel, prov
 	if reason != "" {
 		return
 	}
+	if !modelEnabled(model) {
+		provider = 0
+	}
 
+	oc, ac := s.wkr.clients()
 	switch provider {
 	case 0:
 		reason = "model not supported"
 	case ChatProviderAnthropic:
-		if s.wkr.ac == nil {
+		if ac == nil {
 			reason = "model not supported"
 			return
 		}
@@ -38,7 +59,7 @@ func (s *Server) parseRequest(r *http.Request) (id string, model ChatModel, prov
 			return
 		}
 	case ChatProviderOpenAI:
-		if s.wkr.oc == nil {
+		if oc == nil {
 			reason = "model not supported"
 			return
 		}
@@ -47,9 +68,33 @@ func (s *Server) parseRequest(r *http.Request) (id string, model ChatModel, prov
 			return
 		}
 	}
+
+	if provider != 0 {
+		params.Tools, reason = parseTools(r, id, model)
+		if reason != "" {
+			return
+		}
+		params.ResponseFormat, reason = parseResponseFormat(r, model, params)
+		if reason != "" {
+			return
+		}
+		params.System, reason = parsePersona(r)
+	}
 	return
 }
 
+func parsePersona(r *http.Request) (string, string) {
+	name := r.FormValue("persona")
+	if name == "" {
+		return "", ""
+	}
+	prompt, ok := personaPrompt(name)
+	if !ok {
+		return "", "unknown persona"
+	}
+	return prompt, ""
+}
+
 func parseID(r *http.Request) (string, string) {
 	id := r.FormValue("id")
 	if id == "" {
@@ -64,6 +109,30 @@ func parseID(r *http.Request) (string, string) {
 	return id, ""
 }
 
+// AssistantName is the assistant's nickname; users cannot take it.
+const AssistantName = "burp"
+
+func parseNick(r *http.Request) (string, string) {
+	nick := r.FormValue("nick")
+	if nick == "" {
+		return "", ""
+	}
+	return nick, validNick(nick)
+}
+
+func validNick(nick string) string {
+	if len(nick) > 32 {
+		return "nick must be <= 32 characters"
+	}
+	if !isNonEmptyAlnum(nick) {
+		return "nick must be alphanumeric"
+	}
+	if strings.EqualFold(nick, AssistantName) {
+		return "nick is reserved"
+	}
+	return ""
+}
+
 func parseModel(r *http.Request) (ChatModel, ChatProvider, string) {
 	m := r.FormValue("model")
 	if m == "" {
@@ -82,16 +151,19 @@ func parseOpenAIParams(r *http.Request, model ChatModel) (params messageParams,
 		panic("unknown model or token limit not configured")
 	}
 
+	reasoning := modelCaps[model]&CapReasoning != 0
+
 	// temperature: [0.0, 2.0], default 1.0
-	params.Temperature = 1.0
 	if s := r.FormValue("temp"); s != "" {
 		v, err := strconv.ParseFloat(s, 64)
 		if err != nil {
 			reason = "temp must be a number"
 		} else if v < 0.0 || v > 2.0 {
 			reason = "temp out of range for OpenAI (0.0–2.0)"
+		} else if reasoning {
+			reason = "temp not supported by reasoning models"
 		} else {
-			params.Temperature = v
+			params.Temperature = &v
 		}
 	}
 
@@ -102,11 +174,74 @@ func parseOpenAIParams(r *http.Request, model ChatModel) (params messageParams,
 			reason = "top_p must be a number"
 		} else if v < 0.0 || v > 1.0 {
 			reason = "top_p out of range (0.0–1.0)"
+		} else if reasoning {
+			reason = "top_p not supported by reasoning models"
 		} else {
 			params.TopP = &v
 		}
 	}
 
+	// presence_penalty: [-2.0, 2.0], default 0
+	if s := r.FormValue("presence_penalty"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			reason = "presence_penalty must be a number"
+		} else if v < -2.0 || v > 2.0 {
+			reason = "presence_penalty out of range (-2.0–2.0)"
+		} else if reasoning {
+			reason = "presence_penalty not supported by reasoning models"
+		} else {
+			params.PresencePenalty = &v
+		}
+	}
+
+	// frequency_penalty: [-2.0, 2.0], default 0
+	if s := r.FormValue("frequency_penalty"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			reason = "frequency_penalty must be a number"
+		} else if v < -2.0 || v > 2.0 {
+			reason = "frequency_penalty out of range (-2.0–2.0)"
+		} else if reasoning {
+			reason = "frequency_penalty not supported by reasoning models"
+		} else {
+			params.FrequencyPenalty = &v
+		}
+	}
+
+	// seed: any integer, default nil
+	if s := r.FormValue("seed"); s != "" {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			reason = "seed must be an integer"
+		} else {
+			params.Seed = &v
+		}
+	}
+
+	// stop: up to 4, not supported by reasoning models
+	if stop, why := parseStop(r, 4); why != "" {
+		reason = why
+	} else if stop != nil && reasoning {
+		reason = "stop not supported by reasoning models"
+	} else {
+		params.Stop = stop
+	}
+
+	// reasoning_effort: minimal (GPT-5 only), low, medium, high; default medium
+	if s := r.FormValue("reasoning_effort"); s != "" {
+		switch {
+		case modelCaps[model]&CapReasoningEffort == 0:
+			reason = "model does not support reasoning_effort"
+		case s == "minimal" && !strings.HasPrefix(string(model), "gpt-5"):
+			reason = "reasoning_effort minimal is only supported by GPT-5 models"
+		case s == "minimal" || s == "low" || s == "medium" || s == "high":
+			params.ReasoningEffort = s
+		default:
+			reason = "reasoning_effort must be one of minimal, low, medium, high"
+		}
+	}
+
 	params.MaxTokens = limit
 	if s := r.FormValue("max_tokens"); s != "" {
 		v, err := strconv.ParseInt(s, 10, 64)
@@ -129,7 +264,6 @@ func parseAnthropicParams(r *http.Request, model ChatModel) (params messageParam
 	}
 
 	// temperature: [0.0, 1.0], default 1.0
-	params.Temperature = 1.0
 	if s := r.FormValue("temp"); s != "" {
 		v, err := strconv.ParseFloat(s, 64)
 		if err != nil {
@@ -137,7 +271,7 @@ func parseAnthropicParams(r *http.Request, model ChatModel) (params messageParam
 		} else if v < 0.0 || v > 1.0 {
 			reason = "temp out of range for Anthropic (0.0–1.0)"
 		} else {
-			params.Temperature = v
+			params.Temperature = &v
 		}
 	}
 
@@ -177,9 +311,69 @@ func parseAnthropicParams(r *http.Request, model ChatModel) (params messageParam
 		}
 	}
 
+	// stop: up to 8
+	if stop, why := parseStop(r, 8); why != "" {
+		reason = why
+	} else {
+		params.Stop = stop
+	}
+
+	// thinking_budget: [1024, max_tokens), default 0 (disabled)
+	if s := r.FormValue("thinking_budget"); s != "" {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			reason = "thinking_budget must be an integer"
+		} else if modelCaps[model]&CapThinking == 0 {
+			reason = "model does not support thinking_budget"
+		} else if v < 1024 || v >= params.MaxTokens {
+			reason = "thinking_budget out of range (1024–max_tokens)"
+		} else {
+			params.ThinkingBudget = v
+		}
+	}
+
+	// thinking is incompatible with changes to temperature and top_k,
+	// and only allows top_p between 0.95 and 1.0
+	if params.ThinkingBudget > 0 {
+		if params.Temperature != nil && *params.Temperature != 1.0 || params.TopK != nil {
+			reason = "temp and top_k cannot be changed with thinking_budget"
+		} else if params.TopP != nil && *params.TopP < 0.95 {
+			reason = "top_p must be >= 0.95 with thinking_budget"
+		}
+	}
+
 	return
 }
 
+// parseStop returns the stop sequences given in repeated stop
+// parameters.
+func parseStop(r *http.Request, max int) ([]string, string) {
+	stop := r.Form["stop"]
+	if len(stop) == 0 {
+		return nil, ""
+	}
+	if len(stop) > max {
+		return nil, "at most " + strconv.Itoa(max) + " stop sequences"
+	}
+	for _, s := range stop {
+		if s == "" || len(s) > 64 {
+			return nil, "stop sequences must be 1–64 bytes"
+		}
+	}
+	return stop, ""
+}
+
+func parseTools(r *http.Request, id string, model ChatModel) ([]*Tool, string) {
+	spec := r.FormValue("tools")
+	if spec == "" {
+		return nil, ""
+	}
+	if modelCaps[model]&CapTools == 0 {
+		return nil, "model does not support tools"
+	}
+	return toolsFor(id, spec)
+}
+
 func isNonEmptyAlnum(s string) bool {
 	for i := 0; i < len(s); i++ {
 		c := s[i]
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxSchemaBytes = 16 << 10
+
+// responseToolName is the tool Anthropic models are forced to call to
+// produce structured output.
+const responseToolName = "respond"
+
+// parseResponseFormat reads the response_format parameter, a JSON
+// Schema that the reply must match. The schema must describe an object.
+func parseResponseFormat(r *http.Request, model ChatModel, params messageParams) (json.RawMessage, string) {
+	s := r.FormValue("response_format")
+	if s == "" {
+		return nil, ""
+	}
+	if len(s) > maxSchemaBytes {
+		return nil, "response_format must be <= 16KB"
+	}
+	if modelCaps[model]&CapJSONSchema == 0 {
+		return nil, "model does not support response_format"
+	}
+
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(s), &schema); err != nil {
+		return nil, "response_format must be a JSON Schema object"
+	}
+	if schema["type"] != "object" {
+		return nil, "response_format must describe an object"
+	}
+
+	if providerFor[model] == ChatProviderAnthropic {
+		// Anthropic output is shaped by forcing a tool call, which
+		// rules out other tools and thinking.
+		if len(params.Tools) > 0 {
+			return nil, "response_format cannot be combined with tools on Anthropic models"
+		}
+		if params.ThinkingBudget > 0 {
+			return nil, "response_format cannot be combined with thinking_budget"
+		}
+	}
+	return json.RawMessage(s), ""
+}
+
+// strictKeywords are the schema keywords OpenAI's strict structured
+// output accepts.
+var strictKeywords = map[string]bool{
+	"type": true, "properties": true, "required": true, "additionalProperties": true,
+	"items": true, "enum": true, "const": true, "anyOf": true, "$ref": true,
+	"$defs": true, "definitions": true, "title": true, "description": true,
+	"pattern": true, "format": true, "multipleOf": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true,
+	"minItems": true, "maxItems": true,
+}
+
+// strictSchema reports whether schema can be enforced by OpenAI's strict
+// mode: it only uses strictKeywords, every object lists all of its
+// properties as required and forbids additional ones, and properties
+// are nested at most 5 deep.
+func strictSchema(schema json.RawMessage) bool {
+	var root map[string]any
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return false
+	}
+	return strictValue(root, 0)
+}
+
+func strictValue(s map[string]any, depth int) bool {
+	if depth > 5 {
+		return false
+	}
+	for k := range s {
+		if !strictKeywords[k] {
+			return false
+		}
+	}
+
+	props, ok := s["properties"].(map[string]any)
+	if ok || s["type"] == "object" {
+		if s["additionalProperties"] != false {
+			return false
+		}
+		req, _ := s["required"].([]any)
+		if len(req) != len(props) {
+			return false
+		}
+		for _, name := range req {
+			name, _ := name.(string)
+			ps, ok := props[name].(map[string]any)
+			if !ok || !strictValue(ps, depth+1) {
+				return false
+			}
+		}
+	}
+	if items, ok := s["items"].(map[string]any); ok && !strictValue(items, depth) {
+		return false
+	}
+	anyOf, _ := s["anyOf"].([]any)
+	for _, sub := range anyOf {
+		m, ok := sub.(map[string]any)
+		if !ok || !strictValue(m, depth) {
+			return false
+		}
+	}
+	for _, key := range []string{"$defs", "definitions"} {
+		defs, _ := s[key].(map[string]any)
+		for _, def := range defs {
+			m, ok := def.(map[string]any)
+			if !ok || !strictValue(m, depth) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validateJSON reports whether text is a JSON document matching schema.
+// It understands the keywords providers accept for structured output:
+// type, properties, required, additionalProperties, items, enum, const,
+// anyOf, allOf, $ref to local definitions, and the usual bounds.
+func validateJSON(schema json.RawMessage, text string) error {
+	var root map[string]any
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return err
+	}
+	var v any
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return fmt.Errorf("reply is not JSON: %v", err)
+	}
+	return validateValue(root, root, v, "$", 0)
+}
+
+func validateValue(root, s map[string]any, v any, path string, depth int) error {
+	if depth > 64 {
+		return fmt.Errorf("%s: schema nested too deeply", path)
+	}
+
+	if ref, ok := s["$ref"].(string); ok {
+		def := resolveRef(root, ref)
+		if def == nil {
+			return fmt.Errorf("%s: unresolvable $ref %q", path, ref)
+		}
+		if err := validateValue(root, def, v, path, depth+1); err != nil {
+			return err
+		}
+	}
+
+	if all, ok := s["allOf"].([]any); ok {
+		for _, sub := range all {
+			if m, ok := sub.(map[string]any); ok {
+				if err := validateValue(root, m, v, path, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		var first error
+		for _, sub := range anyOf {
+			m, ok := sub.(map[string]any)
+			if !ok {
+				continue
+			}
+			err := validateValue(root, m, v, path, depth+1)
+			if err == nil {
+				first = nil
+				break
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		if first != nil {
+			return fmt.Errorf("%s: matches none of anyOf: %v", path, first)
+		}
+	}
+
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: not one of the enum values", path)
+		}
+	}
+
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, v) {
+		return fmt.Errorf("%s: does not equal const", path)
+	}
+
+	if t, ok := s["type"]; ok && !matchesType(t, v) {
+		return fmt.Errorf("%s: expected %v, got %s", path, t, jsonType(v))
+	}
+
+	switch v := v.(type) {
+	case string:
+		n := float64(utf8.RuneCountInString(v))
+		if min, ok := s["minLength"].(float64); ok && n < min {
+			return fmt.Errorf("%s: shorter than %v", path, min)
+		}
+		if max, ok := s["maxLength"].(float64); ok && n > max {
+			return fmt.Errorf("%s: longer than %v", path, max)
+		}
+		if p, ok := s["pattern"].(string); ok {
+			// Go's regexp is not ECMA 262; skip patterns it rejects.
+			if re, err := regexp.Compile(p); err == nil && !re.MatchString(v) {
+				return fmt.Errorf("%s: does not match %q", path, p)
+			}
+		}
+	case float64:
+		if min, ok := s["minimum"].(float64); ok && v < min {
+			return fmt.Errorf("%s: less than %v", path, min)
+		}
+		if max, ok := s["maximum"].(float64); ok && v > max {
+			return fmt.Errorf("%s: greater than %v", path, max)
+		}
+		if min, ok := s["exclusiveMinimum"].(float64); ok && v <= min {
+			return fmt.Errorf("%s: not greater than %v", path, min)
+		}
+		if max, ok := s["exclusiveMaximum"].(float64); ok && v >= max {
+			return fmt.Errorf("%s: not less than %v", path, max)
+		}
+	case []any:
+		n := float64(len(v))
+		if min, ok := s["minItems"].(float64); ok && n < min {
+			return fmt.Errorf("%s: fewer than %v items", path, min)
+		}
+		if max, ok := s["maxItems"].(float64); ok && n > max {
+			return fmt.Errorf("%s: more than %v items", path, max)
+		}
+		if items, ok := s["items"].(map[string]any); ok {
+			for i, item := range v {
+				if err := validateValue(root, items, item, path+"["+strconv.Itoa(i)+"]", depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		if req, ok := s["required"].([]any); ok {
+			for _, name := range req {
+				if name, ok := name.(string); ok {
+					if _, ok := v[name]; !ok {
+						return fmt.Errorf("%s: missing required property %q", path, name)
+					}
+				}
+			}
+		}
+		props, _ := s["properties"].(map[string]any)
+		for name, pv := range v {
+			if ps, ok := props[name].(map[string]any); ok {
+				if err := validateValue(root, ps, pv, path+"."+name, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			switch ap := s["additionalProperties"].(type) {
+			case bool:
+				if !ap {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+			case map[string]any:
+				if err := validateValue(root, ap, pv, path+"."+name, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// resolveRef looks up a local reference such as "#/$defs/item".
+func resolveRef(root map[string]any, ref string) map[string]any {
+	if ref == "#" {
+		return root
+	}
+	rest, ok := strings.CutPrefix(ref, "#/")
+	if !ok {
+		return nil
+	}
+	var cur any = root
+	for _, part := range strings.Split(rest, "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil
+		}
+		cur = m[part]
+	}
+	m, _ := cur.(map[string]any)
+	return m
+}
+
+func matchesType(t, v any) bool {
+	switch t := t.(type) {
+	case string:
+		return matchesTypeName(t, v)
+	case []any:
+		for _, name := range t {
+			if name, ok := name.(string); ok && matchesTypeName(name, v) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesTypeName(name string, v any) bool {
+	if name == "integer" {
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	}
+	return name == jsonType(v)
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateJSON(t *testing.T) {
+	const person = `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"score": {"type": "number", "exclusiveMaximum": 1},
+			"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "maxItems": 2},
+			"pet": {"anyOf": [{"$ref": "#/$defs/dog"}, {"type": "null"}]}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"$defs": {
+			"tag": {"type": "string", "enum": ["a", "b"]},
+			"dog": {
+				"type": "object",
+				"properties": {"kind": {"const": "dog"}, "good": {"type": "boolean"}},
+				"required": ["kind"],
+				"additionalProperties": {"type": "boolean"}
+			}
+		}
+	}`
+
+	tests := []struct {
+		name, schema, text string
+		ok                 bool
+	}{
+		{"valid", person, `{"name": "emu", "age": 3}`, true},
+		{"all properties", person, `{"name": "emu", "age": 3, "score": 0.5, "tags": ["a", "b"], "pet": {"kind": "dog", "good": true}}`, true},
+		{"not JSON", person, `{"name": "emu",`, false},
+		{"not an object", person, `[]`, false},
+
+		{"missing required", person, `{"name": "emu"}`, false},
+		{"wrong type", person, `{"name": 1, "age": 3}`, false},
+		{"too short", person, `{"name": "", "age": 3}`, false},
+
+		{"integer as float", person, `{"name": "emu", "age": 3.0}`, true},
+		{"fraction for integer", person, `{"name": "emu", "age": 3.5}`, false},
+		{"integer for number", person, `{"name": "emu", "age": 3, "score": 0}`, true},
+		{"string for number", person, `{"name": "emu", "age": 3, "score": "0"}`, false},
+		{"below minimum", person, `{"name": "emu", "age": -1}`, false},
+		{"exclusive maximum", person, `{"name": "emu", "age": 3, "score": 1}`, false},
+
+		{"additional property", person, `{"name": "emu", "age": 3, "x": 1}`, false},
+		{"additional property schema", person, `{"name": "emu", "age": 3, "pet": {"kind": "dog", "fluffy": true}}`, true},
+		{"additional property mismatch", person, `{"name": "emu", "age": 3, "pet": {"kind": "dog", "fluffy": 1}}`, false},
+
+		{"$ref in items", person, `{"name": "emu", "age": 3, "tags": ["c"]}`, false},
+		{"too many items", person, `{"name": "emu", "age": 3, "tags": ["a", "a", "a"]}`, false},
+		{"anyOf second", person, `{"name": "emu", "age": 3, "pet": null}`, true},
+		{"anyOf none", person, `{"name": "emu", "age": 3, "pet": {"kind": "cat"}}`, false},
+		{"anyOf wrong type", person, `{"name": "emu", "age": 3, "pet": 1}`, false},
+
+		{"unresolvable $ref", `{"type": "object", "properties": {"a": {"$ref": "#/$defs/x"}}}`, `{"a": 1}`, false},
+		{"remote $ref", `{"type": "object", "properties": {"a": {"$ref": "other.json"}}}`, `{"a": 1}`, false},
+		{"escaped $ref", `{"type": "object", "properties": {"a": {"$ref": "#/$defs/a~1b"}}, "$defs": {"a/b": {"type": "string"}}}`, `{"a": "x"}`, true},
+		{"recursive $ref", `{"type": "object", "properties": {"next": {"anyOf": [{"$ref": "#"}, {"type": "null"}]}}, "additionalProperties": false}`,
+			`{"next": {"next": {"next": null}}}`, true},
+		{"recursive $ref mismatch", `{"type": "object", "properties": {"next": {"anyOf": [{"$ref": "#"}, {"type": "null"}]}}, "additionalProperties": false}`,
+			`{"next": {"next": {"x": null}}}`, false},
+		{"allOf", `{"type": "object", "allOf": [{"required": ["a"]}, {"required": ["b"]}]}`, `{"a": 1}`, false},
+		{"type list", `{"type": "object", "properties": {"a": {"type": ["string", "null"]}}}`, `{"a": null}`, true},
+		{"pattern", `{"type": "object", "properties": {"a": {"type": "string", "pattern": "^[a-z]+$"}}}`, `{"a": "A"}`, false},
+	}
+	for _, tt := range tests {
+		err := validateJSON(json.RawMessage(tt.schema), tt.text)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: validateJSON(%s) = %v, want ok %v", tt.name, tt.text, err, tt.ok)
+		}
+	}
+}
+
+func TestStrictSchema(t *testing.T) {
+	tests := []struct {
+		name, schema string
+		want         bool
+	}{
+		{"strict", `{"type": "object", "properties": {"a": {"type": "string"}, "b": {"type": ["integer", "null"]}}, "required": ["a", "b"], "additionalProperties": false}`, true},
+		{"no properties", `{"type": "object", "additionalProperties": false}`, true},
+		{"additional properties allowed", `{"type": "object", "properties": {"a": {"type": "string"}}, "required": ["a"]}`, false},
+		{"additional properties schema", `{"type": "object", "properties": {"a": {"type": "string"}}, "required": ["a"], "additionalProperties": {"type": "string"}}`, false},
+		{"optional property", `{"type": "object", "properties": {"a": {"type": "string"}, "b": {"type": "string"}}, "required": ["a"], "additionalProperties": false}`, false},
+		{"required unknown property", `{"type": "object", "properties": {"a": {"type": "string"}}, "required": ["b"], "additionalProperties": false}`, false},
+		{"unsupported keyword", `{"type": "object", "properties": {"a": {"type": "string", "minLength": 1}}, "required": ["a"], "additionalProperties": false}`, false},
+		{"allOf", `{"type": "object", "allOf": [], "additionalProperties": false}`, false},
+		{"nested loose object", `{"type": "object", "properties": {"a": {"type": "object", "properties": {}}}, "required": ["a"], "additionalProperties": false}`, false},
+		{"loose object in items", `{"type": "object", "properties": {"a": {"type": "array", "items": {"type": "object"}}}, "required": ["a"], "additionalProperties": false}`, false},
+		{"strict items", `{"type": "object", "properties": {"a": {"type": "array", "items": {"type": "object", "properties": {"b": {"type": "number"}}, "required": ["b"], "additionalProperties": false}}}, "required": ["a"], "additionalProperties": false}`, true},
+		{"anyOf", `{"type": "object", "properties": {"a": {"anyOf": [{"type": "string"}, {"$ref": "#/$defs/b"}]}}, "required": ["a"], "additionalProperties": false, "$defs": {"b": {"type": "object", "properties": {}, "required": [], "additionalProperties": false}}}`, true},
+		{"loose anyOf", `{"type": "object", "properties": {"a": {"anyOf": [{"type": "string"}, {"type": "object"}]}}, "required": ["a"], "additionalProperties": false}`, false},
+		{"loose $defs", `{"type": "object", "properties": {}, "required": [], "additionalProperties": false, "$defs": {"b": {"type": "object"}}}`, false},
+		{"loose definitions", `{"type": "object", "properties": {}, "required": [], "additionalProperties": false, "definitions": {"b": {"type": "string", "format": "uuid", "oneOf": []}}}`, false},
+		{"5 levels", nestedSchema(5), true},
+		{"6 levels", nestedSchema(6), false},
+		{"not JSON", `{`, false},
+	}
+	for _, tt := range tests {
+		if got := strictSchema(json.RawMessage(tt.schema)); got != tt.want {
+			t.Errorf("%s: strictSchema = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// nestedSchema returns a strict schema whose properties are nested n deep.
+func nestedSchema(n int) string {
+	s := `{"type": "string"}`
+	for range n {
+		s = `{"type": "object", "properties": {"a": ` + s + `}, "required": ["a"], "additionalProperties": false}`
+	}
+	return s
+}
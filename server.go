@@ -3,16 +3,21 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"html/template"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tetsuo/burp/static"
 )
 
 type Server struct {
-	wkr *Worker
+	wkr  *Worker
+	auth *Auth    // nil disables authentication
+	lim  *Limiter // nil disables rate limiting
 }
 
 func (s *Server) serveWait(w http.ResponseWriter, r *http.Request) {
@@ -26,6 +31,9 @@ func (s *Server) serveWait(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, reason, http.StatusBadRequest)
 		return
 	}
+	if !s.authorize(w, r, id, RoleRead) {
+		return
+	}
 
 	var after time.Time
 	if v := r.FormValue("after"); v != "" {
@@ -60,7 +68,7 @@ func (s *Server) serveWait(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, msg.json)
 }
 
-func serveRecent(w http.ResponseWriter, r *http.Request) {
+func (s *Server) serveRecent(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -71,6 +79,9 @@ func serveRecent(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, reason, http.StatusBadRequest)
 		return
 	}
+	if !s.authorize(w, r, id, RoleRead) {
+		return
+	}
 
 	var after time.Time
 	if v := r.FormValue("after"); v != "" {
@@ -85,6 +96,7 @@ func serveRecent(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
 	mu.Lock()
+	touchLocked(id)
 
 	var buf bytes.Buffer
 	buf.WriteString("[\n")
@@ -112,28 +124,109 @@ func (s *Server) serveAsk(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	multipart := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	if multipart {
+		if err := r.ParseMultipartForm(8 << 20); err != nil {
+			http.Error(w, "bad multipart body", http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+	}
+
 	id, model, _, params, reason := s.parseRequest(r)
 	if reason != "" {
 		http.Error(w, reason, http.StatusBadRequest)
 		return
 	}
+	if !s.authorize(w, r, id, RoleWrite) {
+		return
+	}
 
-	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, modelMaxInputChars[model]))
-	if err != nil {
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	author, reason := parseNick(r)
+	if reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return
+	}
+	if ident, ok := identityFrom(r.Context()); ok {
+		if author != "" && author != ident.Name {
+			http.Error(w, "nick does not match credentials", http.StatusForbidden)
+			return
+		}
+		author = ident.Name
+	}
+
+	// Every post takes a request token, whether or not it starts a
+	// reply; only replies are held to the token quota.
+	client, tier := clientKey(r), modelTier[model]
+	if retryAfter, reason := s.lim.AllowRequest(client, tier); reason != "" {
+		tooManyRequests(w, retryAfter, reason)
 		return
 	}
 
-	body := string(b)
+	var body string
+	if multipart {
+		body = r.FormValue("text")
+		if int64(len(body)) > modelMaxInputChars[model] {
+			http.Error(w, "text too long", http.StatusBadRequest)
+			return
+		}
+	} else {
+		b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, modelMaxInputChars[model]))
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body = string(b)
+	}
+
+	reply := shouldReply(id, body)
+
+	if reply {
+		if retryAfter, reason := s.lim.CheckQuota(client, tier); reason != "" {
+			tooManyRequests(w, retryAfter, reason)
+			return
+		}
+		if s.wkr.Draining() {
+			serviceUnavailable(w, 5*time.Second, "server shutting down")
+			return
+		}
+		if retryAfter, ok := s.wkr.Available(model); !ok {
+			serviceUnavailable(w, retryAfter, "model unavailable")
+			return
+		}
+	}
+
+	// Store attachments only once the message is accepted.
+	var atts []*Attachment
+	if multipart {
+		if atts, reason = s.readAttachments(r, model); reason != "" {
+			http.Error(w, reason, http.StatusBadRequest)
+			return
+		}
+	}
 
-	publish(&Message{
-		ID:   id,
-		Body: body,
-		Role: UserMessage,
+	publishContext(r.Context(), &Message{
+		ID:          id,
+		Body:        body,
+		Author:      author,
+		Attachments: atts,
+		Role:        UserMessage,
 	})
 
-	// kick off work in the background
-	go s.wkr.Send(context.Background(), id, body, model, params)
+	if !reply {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// kick off work in the background, keeping the request ID
+	err := s.wkr.Start(context.WithoutCancel(r.Context()), id, body, model, params, func(usage Usage, _ string) {
+		s.lim.Charge(client, modelTier[usage.Model], usage.OutputTokens)
+	})
+	if err != nil {
+		// Draining started after the check above.
+		serviceUnavailable(w, 5*time.Second, err.Error())
+		return
+	}
 
 	w.WriteHeader(http.StatusAccepted)
 }
@@ -149,6 +242,41 @@ func (s *Server) serveChat(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, reason, http.StatusBadRequest)
 		return
 	}
+	if !s.authorize(w, r, id, RoleRead) {
+		return
+	}
+
+	nick, reason := parseNick(r)
+	if reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return
+	}
+	if ident, ok := identityFrom(r.Context()); ok {
+		nick = ident.Name
+	}
+
+	// Never embed an API key in the page: hand it a short-lived token
+	// for this channel instead, unless it was opened with one. The page
+	// loads its assets with plain requests, so the token is set as a
+	// cookie as well.
+	var token string
+	if s.auth != nil {
+		ident, _ := identityFrom(r.Context())
+		token, _ = credential(r)
+		exp := ident.Expires
+		if ident.Channel == "" {
+			exp = time.Now().Add(chatTokenTTL)
+			token = s.auth.Sign(id, ident.Name, exp)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     tokenCookie,
+			Value:    token,
+			Path:     "/",
+			Expires:  exp,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
@@ -180,19 +308,29 @@ func (s *Server) serveChat(w http.ResponseWriter, r *http.Request) {
     </div>
 
     <script>
-      const chat = new Chat({
+      const chat = new Chat({`)
+	if nick != "" {
+		io.WriteString(w, `
+        nickname: '`)
+		io.WriteString(w, nick)
+		io.WriteString(w, `',`)
+	}
+	io.WriteString(w, `
         channel: '`)
 	io.WriteString(w, id)
 	io.WriteString(w, `',
         model: '`)
 	io.WriteString(w, string(model))
 	io.WriteString(w, `',
-        temperature: `)
-	io.WriteString(w, strconv.FormatFloat(params.Temperature, 'g', 17, 64))
-	io.WriteString(w, `,
         maxTokens: `)
 	io.WriteString(w, strconv.FormatInt(params.MaxTokens, 10))
 
+	if params.Temperature != nil {
+		io.WriteString(w, `,
+        temperature: `)
+		io.WriteString(w, strconv.FormatFloat(*params.Temperature, 'g', 17, 64))
+	}
+
 	if params.TopP != nil {
 		io.WriteString(w, `,
         topP: `)
@@ -205,6 +343,66 @@ func (s *Server) serveChat(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, strconv.FormatInt(*params.TopK, 10))
 	}
 
+	if params.PresencePenalty != nil {
+		io.WriteString(w, `,
+        presencePenalty: `)
+		io.WriteString(w, strconv.FormatFloat(*params.PresencePenalty, 'g', 17, 64))
+	}
+
+	if params.FrequencyPenalty != nil {
+		io.WriteString(w, `,
+        frequencyPenalty: `)
+		io.WriteString(w, strconv.FormatFloat(*params.FrequencyPenalty, 'g', 17, 64))
+	}
+
+	if params.Seed != nil {
+		io.WriteString(w, `,
+        seed: `)
+		io.WriteString(w, strconv.FormatInt(*params.Seed, 10))
+	}
+
+	if len(params.Stop) > 0 {
+		// json.Marshal escapes <, > and & for use in a script
+		stop, _ := json.Marshal(params.Stop)
+		io.WriteString(w, `,
+        stop: `)
+		w.Write(stop)
+	}
+
+	if params.ThinkingBudget > 0 {
+		io.WriteString(w, `,
+        thinkingBudget: `)
+		io.WriteString(w, strconv.FormatInt(params.ThinkingBudget, 10))
+	}
+
+	if params.ReasoningEffort != "" {
+		io.WriteString(w, `,
+        reasoningEffort: '`)
+		io.WriteString(w, params.ReasoningEffort)
+		io.WriteString(w, `'`)
+	}
+
+	if v := r.FormValue("tools"); v != "" {
+		io.WriteString(w, `,
+        tools: '`)
+		io.WriteString(w, template.JSEscapeString(v))
+		io.WriteString(w, `'`)
+	}
+
+	if params.ResponseFormat != nil {
+		io.WriteString(w, `,
+        responseFormat: '`)
+		io.WriteString(w, template.JSEscapeString(string(params.ResponseFormat)))
+		io.WriteString(w, `'`)
+	}
+
+	if s.auth != nil {
+		io.WriteString(w, `,
+        token: '`)
+		io.WriteString(w, template.JSEscapeString(token))
+		io.WriteString(w, `'`)
+	}
+
 	io.WriteString(w, `,
         subscribeUrl: new URL('/', window.location.href),
         publishUrl: new URL('/', window.location.href),
@@ -231,19 +429,50 @@ func (s *Server) serveRoot(w http.ResponseWriter, r *http.Request) {
   <li><b><a href="/chat">/chat</a></b>: chat in a channel</li>
   <li><b><a href="/wait">/wait</a></b>: long-poll 30s for next message (use ?id=&lt;channel&gt;&amp;after=&lt;RFC3339Nano&gt;)</li>
   <li><b><a href="/recent">/recent</a></b>: recent messages in a channel</li>
+  <li><b>/blob</b>: an attachment of a recent message (use ?id=&lt;channel&gt;&amp;hash=&lt;sha256&gt;)</li>
+  <li><b><a href="/acl">/acl</a></b>: show a channel's access list, or POST to claim it and manage members (use ?id=&lt;channel&gt;&amp;member=&lt;name&gt;&amp;role=read|write|none)</li>
+  <li><b><a href="/mode">/mode</a></b>: show a channel's reply mode, or POST to set it (use ?id=&lt;channel&gt;&amp;mode=always|mention)</li>
+  <li><b>/mcp</b>: MCP endpoint (streamable HTTP) with the post_message, read_recent, wait_for_message and ask_model tools</li>
+  <li><b><a href="/healthz/providers">/healthz/providers</a></b>: provider and model health, with circuit breaker states</li>
+  <li><b><a href="/metrics">/metrics</a></b>: Prometheus metrics</li>
+  <li><b><a href="/admin/channels">/admin/channels</a></b>, <b><a href="/admin/work">/admin/work</a></b>, <b>/admin/purge</b>, <b>/admin/cancel</b>: channel and generation management, for admin API keys</li>
+  <li><b>/token</b>: POST to mint a channel token (use ?id=&lt;channel&gt;&amp;ttl=&lt;duration&gt;&amp;sub=&lt;name&gt;)</li>
 </ul></body></html>`)
 }
 
+// maxBytes caps the request body before any handler parses it.
+func maxBytes(n int64, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		h(w, r)
+	}
+}
+
 func (s *Server) Install(mux *http.ServeMux) {
-	mux.Handle("/static/",
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, instrument(pattern, h))
+	}
+
+	handle("/static/", s.auth.require(
 		http.StripPrefix("/static",
 			http.FileServer(http.FS(static.FS)),
-		),
-	)
-
-	mux.HandleFunc("/", s.serveRoot)
-	mux.HandleFunc("/wait", s.serveWait)
-	mux.HandleFunc("/recent", serveRecent)
-	mux.HandleFunc("/chat", s.serveChat)
-	mux.HandleFunc("/ask", s.serveAsk)
+		).ServeHTTP,
+	))
+
+	handle("/", s.auth.require(s.serveRoot))
+	handle("/wait", s.auth.require(s.serveWait))
+	handle("/recent", s.auth.require(s.serveRecent))
+	handle("/chat", s.auth.require(s.serveChat))
+	handle("/ask", maxBytes(maxUploadBytes+1<<20, s.auth.require(s.serveAsk)))
+	handle("/blob", s.auth.require(s.serveBlob))
+	handle("/token", s.auth.require(s.serveToken))
+	handle("/acl", s.auth.require(s.serveACL))
+	handle("/mode", s.auth.require(s.serveMode))
+	handle("/mcp", s.auth.require(s.serveMCP))
+	handle("/healthz/providers", s.auth.require(s.serveProviderHealth))
+	handle("/metrics", s.auth.require(s.serveMetrics))
+	handle("/admin/channels", s.auth.require(s.requireAdmin(s.serveAdminChannels)))
+	handle("/admin/purge", s.auth.require(s.requireAdmin(s.serveAdminPurge)))
+	handle("/admin/work", s.auth.require(s.requireAdmin(s.serveAdminWork)))
+	handle("/admin/cancel", s.auth.require(s.requireAdmin(s.serveAdminCancel)))
 }
@@ -1,5 +1,8 @@
 const AssistantMessage = 1
 const UserMessage = 2
+const ToolCallMessage = 3
+const ToolResultMessage = 4
+const ThinkingMessage = 5
 
 const AssistantName = 'burp'
 const StatusName = '!status'
@@ -13,6 +16,15 @@ class Chat {
     maxTokens,
     topP,
     topK,
+    thinkingBudget,
+    reasoningEffort,
+    presencePenalty,
+    frequencyPenalty,
+    seed,
+    stop,
+    responseFormat,
+    tools,
+    token,
     subscribeUrl,
     publishUrl,
   } = {}) {
@@ -22,6 +34,7 @@ class Chat {
 
     this.subscribeUrl = subscribeUrl
     this.publishUrl = publishUrl
+    this.token = token
 
     this.lastTime = null
     this.msgBuffer = ''
@@ -33,6 +46,16 @@ class Chat {
     this.maxTokens = maxTokens
     this.topP = topP
     this.topK = topK
+    this.thinkingBudget = thinkingBudget
+    this.reasoningEffort = reasoningEffort
+    this.presencePenalty = presencePenalty
+    this.frequencyPenalty = frequencyPenalty
+    this.seed = seed
+    this.stop = stop || []
+    this.responseFormat = responseFormat
+    this.tools = tools
+    this.attachments = []
+    this.thinkingLine = null
   }
 
   setUserNickname(nickname = this.nickname) {
@@ -76,7 +99,9 @@ class Chat {
         container.appendChild(span)
       }
 
-      addParam('🔥', parseFloat(this.temperature.toFixed(7)), 'temperature')
+      if (Number.isFinite(this.temperature)) {
+        addParam('🔥', parseFloat(this.temperature.toFixed(7)), 'temperature')
+      }
 
       if (Number.isFinite(this.topP)) {
         addParam('🔮', parseFloat(this.topP.toFixed(7)), 'top-p')
@@ -89,6 +114,34 @@ class Chat {
       if (Number.isInteger(this.maxTokens)) {
         addParam('⏳', formatMaxTokens(this.maxTokens), 'max tokens', this.maxTokens)
       }
+
+      if (Number.isInteger(this.thinkingBudget)) {
+        addParam('🧠', formatMaxTokens(this.thinkingBudget), 'thinking budget', this.thinkingBudget)
+      }
+
+      if (this.reasoningEffort) {
+        addParam('🧠', this.reasoningEffort, 'reasoning effort')
+      }
+
+      if (Number.isFinite(this.presencePenalty)) {
+        addParam('👀', parseFloat(this.presencePenalty.toFixed(7)), 'presence penalty')
+      }
+
+      if (Number.isFinite(this.frequencyPenalty)) {
+        addParam('🔁', parseFloat(this.frequencyPenalty.toFixed(7)), 'frequency penalty')
+      }
+
+      if (Number.isInteger(this.seed)) {
+        addParam('🌱', this.seed, 'seed')
+      }
+
+      if (this.stop.length) {
+        addParam('🛑', this.stop.length, 'stop sequences', JSON.stringify(this.stop))
+      }
+
+      if (this.responseFormat) {
+        addParam('📐', 'json', 'response format', this.responseFormat)
+      }
     }
   }
 
@@ -193,22 +246,81 @@ class Chat {
     this.elements.chatLines.appendChild(line)
 
     this.elements.chatLines.scrollTop = this.elements.chatLines.scrollHeight
+    return line
+  }
+
+  addAttachment(att, sender, timeISO) {
+    const line = this.addMessage(`📎 ${att.Name}`, sender, timeISO)
+    const u = new URL('/blob', this.subscribeUrl)
+    u.searchParams.set('id', this.channel)
+    u.searchParams.set('hash', att.Hash)
+    const a = document.createElement('a')
+    a.href = u.toString()
+    a.textContent = line.lastChild.textContent
+    a.target = '_blank'
+    a.rel = 'noreferrer noopener'
+    line.lastChild.replaceChildren(a)
+  }
+
+  // addThinking appends thinking text to a collapsed line, started
+  // anew after each reply.
+  addThinking(text, timeISO) {
+    if (!this.thinkingLine) {
+      const line = this.addMessage('thinking…', AssistantName, timeISO)
+      const details = document.createElement('details')
+      details.className = 'thinking'
+      const summary = document.createElement('summary')
+      summary.textContent = 'thinking…'
+      const thought = document.createElement('div')
+      thought.className = 'thought'
+      details.append(summary, thought)
+      line.lastChild.replaceChildren(details)
+      this.thinkingLine = thought
+    }
+    this.thinkingLine.textContent += text
+  }
+
+  attach(files) {
+    for (const file of files) {
+      this.attachments.push(file)
+      this.addMessage(`attached ${file.name}; it is sent with your next message`, StatusName, new Date())
+    }
   }
 
   bindInput() {
+    // files can be pasted or dropped onto the input
+    this.elements.input.addEventListener('paste', e => {
+      if (e.clipboardData.files.length) {
+        e.preventDefault()
+        this.attach(e.clipboardData.files)
+      }
+    })
+    this.elements.input.addEventListener('dragover', e => e.preventDefault())
+    this.elements.input.addEventListener('drop', e => {
+      e.preventDefault()
+      this.attach(e.dataTransfer.files)
+    })
+
     this.elements.form.addEventListener('submit', e => {
       e.preventDefault()
       const msg = this.elements.input.value.trim()
-      if (!msg) {
+      if (!msg && !this.attachments.length) {
         return
       }
 
       this.elements.input.value = ''
+      const files = this.attachments
+      this.attachments = []
 
       this.startSpinner()
 
-      this._send(msg)
+      this._send(msg, files)
         .then(res => {
+          // no reply coming; the channel only answers mentions
+          if (res.status === 204) {
+            this.stopSpinner()
+            return
+          }
           if (!res.ok) {
             this.stopSpinner()
             this.addMessage(
@@ -245,17 +357,29 @@ class Chat {
     }
 
     const body = msg.Body || ''
-    if (msg.Role !== AssistantMessage && !body.trim()) {
+    const attachments = msg.Attachments || []
+    if (msg.Role !== AssistantMessage && !body.trim() && !attachments.length) {
       return
     }
 
     // Handle by role
     if (msg.Role === UserMessage) {
-      this.addMessage(body, this.nickname, msg.Time)
+      this.addMessage(body, msg.Author || 'anon', msg.Time)
+      for (const att of attachments) {
+        this.addAttachment(att, msg.Author || 'anon', msg.Time)
+      }
+      return
+    }
+
+    if (msg.Role === ThinkingMessage) {
+      this.addThinking(body, msg.Time)
       return
     }
 
     if (msg.Role === AssistantMessage) {
+      this.thinkingLine = null
+      const { SchemaValid: schemaValid, SchemaError: schemaError } = msg
+
       // EOF:
       if (body === '') {
         // flush any remaining buffered text
@@ -266,6 +390,9 @@ class Chat {
             this.addMessage(err.message || String(err), AssistantName)
           })
         }
+        if (schemaValid === false) {
+          this.addMessage(`reply does not match the schema: ${schemaError}`, StatusName)
+        }
         this.stopSpinner()
         return
       }
@@ -288,6 +415,21 @@ class Chat {
       return
     }
 
+    if (msg.Role === ToolCallMessage || msg.Role === ToolResultMessage) {
+      // flush the partial line that preceded the tool call
+      const pending = this.msgBuffer.trim()
+      this.msgBuffer = ''
+      if (pending) {
+        this.addMessage(pending, AssistantName)
+      }
+      const text =
+        msg.Role === ToolCallMessage
+          ? `⚙ ${msg.Tool}(${body})`
+          : `${msg.ToolError ? '✗' : '→'} ${msg.Tool}: ${body}`
+      this.addMessage(text, StatusName, msg.Time)
+      return
+    }
+
     console.error(`unknown role "${msg.Role}"; skipping message: ${JSON.stringify(msg)}`)
   }
 
@@ -296,7 +438,7 @@ class Chat {
       const u = new URL('/recent', this.subscribeUrl)
       u.searchParams.set('id', this.channel)
 
-      const res = await fetch(u.toString())
+      const res = await fetch(u.toString(), { headers: this._headers() })
       if (!res.ok) {
         this.addMessage(
           ['failed to retrieve chat history:', res.statusText.toLowerCase(), String(res.status)].join(' '),
@@ -328,12 +470,17 @@ class Chat {
           u.searchParams.set('after', this.lastTime)
         }
 
-        const res = await fetch(u.toString())
+        const res = await fetch(u.toString(), { headers: this._headers() })
         if (!res.ok) {
           throw new Error('status ' + res.status)
         }
 
         const msg = await res.json()
+        if (msg.Shutdown) {
+          this.addMessage('server restarting; reconnecting in 5s', StatusName, new Date())
+          await new Promise(r => setTimeout(r, 5000))
+          continue
+        }
         this.renderMessage(msg)
       } catch (err) {
         this.addMessage(
@@ -347,11 +494,14 @@ class Chat {
   }
 
   // Protected methods to be overridden
-  async _send(msg) {
+  async _send(msg, files = []) {
     const u = new URL('/ask', this.publishUrl)
     u.searchParams.set('id', this.channel)
     u.searchParams.set('model', this.model)
-    u.searchParams.set('temp', this.temperature)
+    u.searchParams.set('nick', this.nickname)
+    if (Number.isFinite(this.temperature)) {
+      u.searchParams.set('temp', this.temperature)
+    }
     u.searchParams.set('max_tokens', this.maxTokens)
     if (Number.isFinite(this.topP)) {
       u.searchParams.set('top_p', this.topP)
@@ -359,13 +509,49 @@ class Chat {
     if (Number.isInteger(this.topK)) {
       u.searchParams.set('top_k', this.topK)
     }
+    if (Number.isInteger(this.thinkingBudget)) {
+      u.searchParams.set('thinking_budget', this.thinkingBudget)
+    }
+    if (this.reasoningEffort) {
+      u.searchParams.set('reasoning_effort', this.reasoningEffort)
+    }
+    if (Number.isFinite(this.presencePenalty)) {
+      u.searchParams.set('presence_penalty', this.presencePenalty)
+    }
+    if (Number.isFinite(this.frequencyPenalty)) {
+      u.searchParams.set('frequency_penalty', this.frequencyPenalty)
+    }
+    if (Number.isInteger(this.seed)) {
+      u.searchParams.set('seed', this.seed)
+    }
+    for (const s of this.stop) {
+      u.searchParams.append('stop', s)
+    }
+    if (this.responseFormat) {
+      u.searchParams.set('response_format', this.responseFormat)
+    }
+    if (this.tools) {
+      u.searchParams.set('tools', this.tools)
+    }
+    if (files.length) {
+      const form = new FormData()
+      form.set('text', msg)
+      for (const file of files) {
+        form.append('file', file)
+      }
+      return fetch(u.toString(), { method: 'POST', headers: this._headers(), body: form })
+    }
     return fetch(u.toString(), {
       method: 'POST',
-      headers: { 'Content-Type': 'text/plain' },
+      headers: { ...this._headers(), 'Content-Type': 'text/plain' },
       body: msg,
     })
   }
 
+  _headers() {
+    return this.token ? { Authorization: `Bearer ${this.token}` } : {}
+  }
+
   async _recv(msg) {
     this.addMessage(msg, AssistantName)
   }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+)
+
+// history is the file written by SaveHistory.
+type history struct {
+	Messages map[string][]*Message
+	ACLs     map[string]*channelACL `json:",omitempty"`
+	Modes    map[string]ChannelMode `json:",omitempty"`
+}
+
+// SaveHistory writes the recent messages, the ACLs and the modes of
+// every channel to path, replacing the file atomically.
+func SaveHistory(path string) error {
+	var hist history
+	mu.Lock()
+	hist.Messages = make(map[string][]*Message, len(recent))
+	for id, list := range recent {
+		msgs := make([]*Message, len(list))
+		for i, mj := range list {
+			msgs[i] = mj.Message
+		}
+		hist.Messages[id] = msgs
+	}
+	mu.Unlock()
+
+	aclMu.Lock()
+	hist.ACLs = make(map[string]*channelACL, len(acls))
+	for id, acl := range acls {
+		hist.ACLs[id] = &channelACL{Owner: acl.Owner, Members: maps.Clone(acl.Members)}
+	}
+	aclMu.Unlock()
+
+	modeMu.Lock()
+	hist.Modes = maps.Clone(modes)
+	modeMu.Unlock()
+
+	b, err := json.Marshal(hist)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".history-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op after the rename
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadHistory restores the state saved by SaveHistory and returns how
+// many channels it restored messages of. A missing file is not an
+// error.
+func LoadHistory(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var hist history
+	if err := json.Unmarshal(b, &hist); err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+
+	aclMu.Lock()
+	for id, acl := range hist.ACLs {
+		if acl == nil || acl.Owner == "" {
+			continue
+		}
+		if acl.Members == nil {
+			acl.Members = map[string]ChannelRole{}
+		}
+		acls[id] = acl
+	}
+	aclMu.Unlock()
+
+	modeMu.Lock()
+	for id, m := range hist.Modes {
+		if m != ModeAlways {
+			modes[id] = m
+		}
+	}
+	modeMu.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for id, msgs := range hist.Messages {
+		list := make([]*messageAndJSON, 0, len(msgs))
+		for _, msg := range msgs {
+			msg.ID = id
+			list = append(list, marshalMessage(msg))
+		}
+		if len(list) == 0 {
+			continue
+		}
+		stored -= listBytes(recent[id])
+		recent[id] = list
+		used[id] = list[len(list)-1].Time.Time()
+		stored += listBytes(list)
+		trimRecentLocked(id)
+	}
+	evictLocked("")
+	return len(hist.Messages), nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	anthropic "github.com/anthropics/anthropic-sdk-go"
+	"github.com/openai/openai-go/v2"
+	"github.com/tetsuo/bbq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ToolFunc runs a tool call with the JSON arguments chosen by the model
+// and returns the result shown to the model.
+type ToolFunc func(ctx context.Context, args json.RawMessage) (string, error)
+
+// Tool is a function the model can call.
+type Tool struct {
+	// Name must match ^[a-zA-Z0-9_-]{1,64}$.
+	Name        string
+	Description string
+	// Schema is the JSON Schema of the arguments object.
+	Schema json.RawMessage
+	Func   ToolFunc
+	// Channels restricts the tool to the listed channel IDs. A nil
+	// slice makes it available everywhere.
+	Channels []string
+}
+
+func (t *Tool) availableIn(id string) bool {
+	return t.Channels == nil || slices.Contains(t.Channels, id)
+}
+
+const (
+	maxToolRounds = 8
+	toolTimeout   = 30 * time.Second
+	maxToolResult = 32 << 10
+)
+
+var (
+	toolsMu sync.RWMutex         // guards following
+	tools   = map[string]*Tool{} // name -> tool
+)
+
+// RegisterTool makes t available to the model. It panics if t is
+// malformed or a tool with the same name is already registered.
+func RegisterTool(t *Tool) {
+	if err := registerTool(t); err != nil {
+		panic("burp: " + err.Error())
+	}
+}
+
+func registerTool(t *Tool) error {
+	if !validToolName(t.Name) {
+		return fmt.Errorf("invalid tool name %q", t.Name)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(t.Schema, &schema); err != nil || schema["type"] != "object" {
+		return fmt.Errorf("tool %s schema must be a JSON object schema", t.Name)
+	}
+	if t.Func == nil {
+		return fmt.Errorf("nil func for tool %s", t.Name)
+	}
+
+	toolsMu.Lock()
+	defer toolsMu.Unlock()
+	if _, dup := tools[t.Name]; dup {
+		return fmt.Errorf("tool %s registered twice", t.Name)
+	}
+	tools[t.Name] = t
+	return nil
+}
+
+// unregisterTools removes every tool whose name starts with prefix.
+func unregisterTools(prefix string) {
+	toolsMu.Lock()
+	defer toolsMu.Unlock()
+	for name := range tools {
+		if strings.HasPrefix(name, prefix) {
+			delete(tools, name)
+		}
+	}
+}
+
+func validToolName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !isNonEmptyAlnum(name[i:i+1]) && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// toolsFor resolves a comma-separated list of tool names available in
+// channel id. "*" selects every available tool.
+func toolsFor(id, spec string) ([]*Tool, string) {
+	toolsMu.RLock()
+	defer toolsMu.RUnlock()
+
+	if spec == "*" {
+		out := make([]*Tool, 0, len(tools))
+		for _, t := range tools {
+			if t.availableIn(id) {
+				out = append(out, t)
+			}
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+		return out, ""
+	}
+
+	var out []*Tool
+	for _, name := range strings.Split(spec, ",") {
+		t := tools[strings.TrimSpace(name)]
+		if t == nil || !t.availableIn(id) {
+			return nil, fmt.Sprintf("unknown tool %q", name)
+		}
+		if !slices.Contains(out, t) {
+			out = append(out, t)
+		}
+	}
+	return out, ""
+}
+
+func findTool(ts []*Tool, name string) *Tool {
+	for _, t := range ts {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// runTool executes a tool call requested by the model, publishing the
+// call and its result to the channel through q. It returns the result
+// text and whether it is an error.
+func runTool(ctx context.Context, ts []*Tool, q *bbq.BBQ[chunk], callID, name, args string) (string, bool) {
+	if args == "" {
+		args = "{}"
+	}
+	q.Write(chunk{msg: &Message{Role: ToolCallMessage, Tool: name, CallID: callID, Body: args}})
+
+	ctx, span := tracer.Start(ctx, "execute_tool "+name, trace.WithAttributes(
+		attribute.String("gen_ai.tool.name", name),
+		attribute.String("gen_ai.tool.call.id", callID),
+	))
+	defer span.End()
+
+	result, isErr := "", false
+	if t := findTool(ts, name); t == nil {
+		result, isErr = fmt.Sprintf("unknown tool %q", name), true
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, toolTimeout)
+		res, err := t.Func(ctx, json.RawMessage(args))
+		cancel()
+		if err != nil {
+			result, isErr = err.Error(), true
+		} else {
+			result = res
+		}
+	}
+	if isErr {
+		span.SetStatus(codes.Error, result)
+	}
+	if len(result) > maxToolResult {
+		result = result[:maxToolResult] + "\n[truncated]"
+	}
+
+	q.Write(chunk{msg: &Message{Role: ToolResultMessage, Tool: name, CallID: callID, Body: result, ToolError: isErr}})
+	return result, isErr
+}
+
+func toolsToOpenAI(ts []*Tool) []openai.ChatCompletionToolUnionParam {
+	p := make([]openai.ChatCompletionToolUnionParam, 0, len(ts))
+	for _, t := range ts {
+		var params openai.FunctionParameters
+		json.Unmarshal(t.Schema, &params)
+		p = append(p, openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+			Name:        t.Name,
+			Description: openai.String(t.Description),
+			Parameters:  params,
+		}))
+	}
+	return p
+}
+
+func toolsToAnthropic(ts []*Tool) []anthropic.ToolUnionParam {
+	p := make([]anthropic.ToolUnionParam, 0, len(ts))
+	for _, t := range ts {
+		var schema map[string]any
+		json.Unmarshal(t.Schema, &schema)
+
+		in := anthropic.ToolInputSchemaParam{Properties: schema["properties"]}
+		if req, ok := schema["required"].([]any); ok {
+			for _, r := range req {
+				if s, ok := r.(string); ok {
+					in.Required = append(in.Required, s)
+				}
+			}
+		}
+		for k, v := range schema {
+			if k != "type" && k != "properties" && k != "required" {
+				if in.ExtraFields == nil {
+					in.ExtraFields = map[string]any{}
+				}
+				in.ExtraFields[k] = v
+			}
+		}
+
+		u := anthropic.ToolUnionParamOfTool(in, t.Name)
+		u.OfTool.Description = anthropic.String(t.Description)
+		p = append(p, u)
+	}
+	return p
+}
+
+func init() {
+	RegisterTool(&Tool{
+		Name:        "current_time",
+		Description: "Returns the current date and time, optionally in an IANA time zone such as Europe/Istanbul.",
+		Schema:      json.RawMessage(`{"type":"object","properties":{"timezone":{"type":"string","description":"IANA time zone name; defaults to UTC"}}}`),
+		Func: func(ctx context.Context, args json.RawMessage) (string, error) {
+			var in struct{ Timezone string }
+			if err := json.Unmarshal(args, &in); err != nil {
+				return "", err
+			}
+			loc := time.UTC
+			if in.Timezone != "" {
+				var err error
+				if loc, err = time.LoadLocation(in.Timezone); err != nil {
+					return "", err
+				}
+			}
+			return time.Now().In(loc).Format("Monday, 2 January 2006 15:04:05 MST"), nil
+		},
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records spans once setupTracing has installed a provider;
+// until then it's a no-op.
+var tracer = otel.Tracer("github.com/tetsuo/burp")
+
+// setupTracing exports spans to stderr ("stdout" exporter, kept off
+// stdout for -mcp-stdio) or to an OTLP/HTTP collector ("otlp"), which
+// is configured with the standard OTEL_EXPORTER_OTLP_* environment
+// variables. It returns a function flushing pending spans.
+func setupTracing(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	var (
+		exp sdktrace.SpanExporter
+		err error
+	)
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("invalid trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "burp")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	return tp.Shutdown, nil
+}
+
+// publishContext publishes msg in a span of the trace in ctx.
+func publishContext(ctx context.Context, msg *Message) {
+	_, span := tracer.Start(ctx, "publish", trace.WithAttributes(
+		attribute.String("burp.channel", msg.ID),
+		attribute.Int("burp.message.role", int(msg.Role)),
+		attribute.Int("burp.message.bytes", len(msg.Body)),
+	))
+	publish(msg)
+	span.End()
+}